@@ -0,0 +1,454 @@
+package simplejsondb
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// manifest - the files of a snapshot and their SHA-256, kept in ManifestFile
+type manifest struct {
+	CreatedAt time.Time         `json:"created_at"`
+	Files     map[string]string `json:"files"` // slash separated path relative to the snapshot
+}
+
+// Snapshot writes a point-in-time consistent copy of the database to the directory dst,
+// which must not exist yet, while writers go on. Everything is copied first, then the
+// files written meanwhile and the operation log are copied again with the writes of the
+// opened collections held, so they only wait for that second pass. The copy is a normal
+// database directory with a ManifestFile, see VerifySnapshot.
+func (db *db) Snapshot(dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return &fs.PathError{Op: "snapshot", Path: dst, Err: fs.ErrExist}
+	}
+	tmp, err := tempDir(dst)
+	if err != nil {
+		return err
+	}
+	if err := db.snapshot(OSFS{}, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Backup writes a snapshot of the database, taken as by Snapshot, to w as a tar.gz
+// archive; Restore unpacks and verifies it
+func (db *db) Backup(w io.Writer) error {
+	// a database in memory is snapshotted in memory, others in a temporary directory
+	var to FS = NewMemFS()
+	root := "snapshot"
+	if isOS(db.fs) {
+		dir, err := os.MkdirTemp("", "sjdb-backup-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		to, root = OSFS{}, filepath.Join(dir, root)
+	}
+	if err := db.snapshot(to, root); err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := walkFiles(to, root, func(name string, info fs.FileInfo) error {
+		rel, _ := filepath.Rel(root, name)
+		header := &tar.Header{Name: filepath.ToSlash(rel), Mode: 0o755, ModTime: info.ModTime(), Typeflag: tar.TypeDir}
+		if info.IsDir() {
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		}
+		data, err := to.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		header.Mode, header.Size, header.Typeflag = 0o644, int64(len(data)), tar.TypeReg
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Restore unpacks an archive written by Backup into the directory dst, which must not
+// exist yet, and verifies every file against the manifest before dst appears
+func Restore(r io.Reader, dst string) error {
+	if _, err := os.Stat(dst); err == nil {
+		return &fs.PathError{Op: "restore", Path: dst, Err: fs.ErrExist}
+	}
+	tmp, err := tempDir(dst)
+	if err != nil {
+		return err
+	}
+	if err := untar(r, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := VerifySnapshot(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// tempDir - a new directory next to dst to fill before it is renamed to dst, so it is on
+// the same file system and never one a concurrent call is filling
+func tempDir(dst string) (string, error) {
+	return os.MkdirTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-")
+}
+
+// VerifySnapshot checks the files of the snapshot in dir against its manifest,
+// returning ErrChecksum for a file which is missing, unexpected or changed
+func VerifySnapshot(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("%s: %w", filepath.Join(dir, ManifestFile), err)
+	}
+	sums, err := checksumTree(OSFS{}, dir)
+	if err != nil {
+		return err
+	}
+	for name, sum := range sums {
+		if want, ok := m.Files[name]; !ok {
+			return fmt.Errorf("%w: %s is not part of the snapshot", ErrChecksum, name)
+		} else if want != sum {
+			return fmt.Errorf("%w: %s", ErrChecksum, name)
+		}
+	}
+	for name := range m.Files {
+		if _, ok := sums[name]; !ok {
+			return fmt.Errorf("%w: %s is missing", ErrChecksum, name)
+		}
+	}
+	return nil
+}
+
+// helper: copies the database to dst of to in two passes, then writes the manifest
+func (db *db) snapshot(to FS, dst string) error {
+	if err := db.copySnapshot(to, dst); err != nil {
+		return err
+	}
+	sums, err := checksumTree(to, dst)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest{CreatedAt: time.Now().UTC(), Files: sums}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return to.WriteFile(filepath.Join(dst, ManifestFile), data, os.ModePerm)
+}
+
+// helper: copies the database to dst of to. The opened collections, and those opened
+// while it runs, record what they write from the start of the first pass; db.mu is only
+// held to list them.
+func (db *db) copySnapshot(to FS, dst string) error {
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	db.mu.Lock()
+	db.snapping = true
+	for _, c := range db.collections {
+		db.snapCols = append(db.snapCols, c)
+	}
+	cols := append([]*collection(nil), db.snapCols...)
+	db.mu.Unlock()
+	// a merge running meanwhile is waited for without holding up DB.Collection
+	for _, c := range cols {
+		c.join()
+	}
+	defer func() {
+		db.mu.Lock()
+		cols := db.snapCols
+		db.snapping, db.snapCols = false, nil
+		db.mu.Unlock()
+		for _, c := range cols {
+			c.leave()
+		}
+	}()
+
+	// first pass: everything, while writes go on
+	if err := copyTree(db.fs, db.path, to, dst); err != nil {
+		return err
+	}
+	// second pass: what was written meanwhile, with the writes held
+	db.mu.Lock()
+	cols = append(cols[:0], db.snapCols...)
+	db.mu.Unlock()
+	defer lockAll(cols)()
+	for _, c := range cols {
+		rel, err := filepath.Rel(db.path, c.path)
+		if err != nil {
+			return err
+		}
+		if err := c.resync(to, filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	if err := db.syncOplog(to, filepath.Join(dst, OplogDir)); err != nil {
+		return err
+	}
+	return syncFile(db.fs, filepath.Join(db.path, MetaFile), to, filepath.Join(dst, MetaFile))
+}
+
+// helper: copies the segments of the operation log to dst; with the writes held it ends
+// with the last record copied
+func (db *db) syncOplog(to FS, dst string) error {
+	dir := filepath.Join(db.path, OplogDir)
+	if db.oplog != nil {
+		db.oplog.mu.Lock()
+		defer db.oplog.mu.Unlock()
+		dir = db.oplog.dir
+	} else if !isOS(db.fs) {
+		return nil
+	}
+	segments, err := oplogSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if err := syncFile(OSFS{}, name, to, filepath.Join(dst, filepath.Base(name))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockAll - holds the writes of cols, taking their locks in name order like every
+// caller holding several of them, and returns the function releasing them
+func lockAll(cols []*collection) (unlock func()) {
+	sort.Slice(cols, func(i, j int) bool { return cols[i].name < cols[j].name })
+	for _, c := range cols {
+		c.mu.Lock()
+	}
+	return func() {
+		for i := len(cols) - 1; i >= 0; i-- {
+			cols[i].mu.Unlock()
+		}
+	}
+}
+
+// join - starts recording the files written, for a running snapshot; sealed segments
+// stay as they are without a merge
+func (c *collection) join() {
+	c.track(true)
+	if c.store != nil {
+		c.store.merging.Lock()
+	}
+}
+
+// leave - undoes join once the snapshot is done
+func (c *collection) leave() {
+	if c.store != nil {
+		c.store.merging.Unlock()
+	}
+	c.track(false)
+}
+
+// track - starts or stops recording the files written, for a running snapshot
+func (c *collection) track(on bool) {
+	c.snapMu.Lock()
+	defer c.snapMu.Unlock()
+	c.dirty = nil
+	if on {
+		c.dirty = make(map[string]struct{})
+	}
+}
+
+// markDirty - records a file written while a snapshot is running
+func (c *collection) markDirty(filename string) {
+	c.snapMu.Lock()
+	defer c.snapMu.Unlock()
+	if c.dirty != nil {
+		c.dirty[filename] = struct{}{}
+	}
+}
+
+// helper: copies the files of the collection written since tracking started to dst
+// again, along with the files written without remember: the metadata and change log,
+// which are replaced or appended, and the append-only segments; mu must be held
+func (c *collection) resync(to FS, dst string) error {
+	target := func(name string) string {
+		rel, _ := filepath.Rel(c.path, name)
+		return filepath.Join(dst, rel)
+	}
+	c.snapMu.Lock()
+	dirty := make([]string, 0, len(c.dirty))
+	for name := range c.dirty {
+		dirty = append(dirty, name)
+	}
+	c.snapMu.Unlock()
+	for _, name := range dirty {
+		if err := syncFile(c.fs, name, to, target(name)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range []string{MetaFile, ChangeLogFile, ChangeLogPrevFile} {
+		if err := syncFile(c.fs, filepath.Join(c.path, name), to, target(filepath.Join(c.path, name))); err != nil {
+			return err
+		}
+	}
+	if c.store == nil {
+		return nil
+	}
+	entries, err := c.fs.ReadDir(filepath.Join(c.path, SegmentDir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(c.path, SegmentDir, e.Name())
+		if e.IsDir() || instanceFile(e.Name()) {
+			continue
+		}
+		// segments only grow, and the hint files of sealed ones do not change
+		if info, err := e.Info(); err == nil {
+			if copied, err := to.Stat(target(name)); err == nil && copied.Size() == info.Size() {
+				continue
+			}
+		}
+		if err := syncFile(c.fs, name, to, target(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile - makes dst of to a copy of src of from, removing it when src is gone
+func syncFile(from FS, src string, to FS, dst string) error {
+	data, err := from.ReadFile(src)
+	if errors.Is(err, fs.ErrNotExist) {
+		if err := to.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := mkdirAll(to, filepath.Dir(dst)); err != nil {
+		return err
+	}
+	return to.WriteFile(dst, data, os.ModePerm)
+}
+
+// walkFiles - calls fn for every directory and file below root, parents first
+func walkFiles(fsys FS, root string, fn func(name string, info fs.FileInfo) error) error {
+	entries, err := fsys.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := filepath.Join(root, e.Name())
+		info, err := fsys.Stat(name)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, info); err != nil {
+			return err
+		}
+		if e.IsDir() {
+			if err := walkFiles(fsys, name, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checksumTree - the SHA-256 of every file below root but the manifest, by slash
+// separated relative path
+func checksumTree(fsys FS, root string) (map[string]string, error) {
+	sums := make(map[string]string)
+	err := walkFiles(fsys, root, func(name string, info fs.FileInfo) error {
+		rel, _ := filepath.Rel(root, name)
+		if info.IsDir() || rel == ManifestFile {
+			return nil
+		}
+		data, err := fsys.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(data)
+		sums[filepath.ToSlash(rel)] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return sums, err
+}
+
+// helper: unpacks a tar.gz archive into dir, refusing entries which would land outside it
+func untar(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("restore: invalid path %q in archive", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, os.ModePerm)
+		case tar.TypeReg:
+			if err = os.MkdirAll(filepath.Dir(target), os.ModePerm); err == nil {
+				err = writeEntry(target, tr)
+			}
+		default:
+			err = fmt.Errorf("restore: unsupported entry %q in archive", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// helper: streams one archive entry to the file target
+func writeEntry(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
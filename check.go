@@ -0,0 +1,309 @@
+package simplejsondb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Kinds of the issues reported by DB.Check
+const (
+	// IssueCorrupt - a record failing its checksum
+	IssueCorrupt = "corrupt"
+	// IssueInvalidJSON - a readable record which is not a JSON document
+	IssueInvalidJSON = "invalid-json"
+	// IssueUnreadable - a record failing no checksum which still can not be read, e.g.
+	// broken gzip written by another tool or a sealed record the keys do not open
+	IssueUnreadable = "unreadable"
+	// IssueDuplicate - a file of a key superseded by another variant, e.g. key.json next to key.json.gz
+	IssueDuplicate = "duplicate"
+	// IssueTempFile - a temporary file left behind by an interrupted write
+	IssueTempFile = "temp-file"
+	// IssueStrayDir - a directory inside a collection which is not part of its layout, or
+	// one inside the database which is no collection
+	IssueStrayDir = "stray-dir"
+	// IssueIndex - a segment hint file out of sync with its segment
+	IssueIndex = "index"
+)
+
+// CheckOptions - what DB.Check looks at and whether it repairs what it finds
+type CheckOptions struct {
+	// Collections to check, all of the database when empty
+	Collections []string
+	// Repair quarantines corrupt and invalid records, removes duplicates and temporary
+	// files and rebuilds hint files; stray directories are only reported
+	Repair bool
+}
+
+// CheckReport - the outcome of DB.Check
+type CheckReport struct {
+	Collections int     // collections checked
+	Records     int     // record files, or segment entries, read
+	Issues      []Issue // grouped by collection
+}
+
+// Issue - one problem found by DB.Check
+type Issue struct {
+	Collection string
+	Key        string // empty for files which are not records
+	Path       string // relative to the database directory
+	Kind       string // one of the Issue kinds
+	Detail     string
+	Repaired   bool
+}
+
+// OK - reports whether every issue found was repaired
+func (r *CheckReport) OK() bool {
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// String - the issue as one line of a report
+func (i Issue) String() string {
+	s := fmt.Sprintf("%s: %s", i.Path, i.Kind)
+	if i.Detail != "" {
+		s += ": " + i.Detail
+	}
+	if i.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// Check audits the database directory: records which fail their checksum, are not JSON or
+// can not be read, duplicate variants of a key, leftover temporary files, stray directories
+// and segment hint files out of sync with their segments. Only directories holding a
+// collection are opened as one, others are reported as stray. Metadata.Indexes holds index
+// names only, so the hint files are the only index data there is to verify. Writes to a
+// collection wait while it is checked.
+func (db *db) Check(opts CheckOptions) (*CheckReport, error) {
+	if opts.Repair && db.readOnly {
+		return nil, ErrReadOnly
+	}
+	names := opts.Collections
+	for _, name := range names {
+		if _, err := db.fs.Stat(filepath.Join(db.path, name)); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) == 0 {
+		entries, err := db.fs.ReadDir(db.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+				names = append(names, e.Name())
+			}
+		}
+	}
+
+	report := &CheckReport{}
+	db.checkTemp(opts.Repair, report)
+	for _, name := range names {
+		// opening it would turn the directory into a collection
+		if dir := filepath.Join(db.path, name); !db.isCollection(dir) {
+			report.add(db.path, Issue{Path: dir, Kind: IssueStrayDir})
+			continue
+		}
+		col, err := db.Collection(name)
+		if err != nil {
+			return nil, err
+		}
+		c := col.(*collection)
+		c.mu.Lock()
+		err = c.check(db.path, opts.Repair, report)
+		c.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		report.Collections++
+	}
+	return report, nil
+}
+
+// helper: reports whether dir holds a collection: its metadata file, or records written
+// before there was one
+func (db *db) isCollection(dir string) bool {
+	entries, err := db.fs.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+	for _, e := range entries {
+		if e.Name() == MetaFile {
+			return true
+		}
+		if codec, _ := db.codecs.byFile(e.Name()); codec != nil && !e.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// helper: reports the temporary files in the database directory itself
+func (db *db) checkTemp(repair bool, report *CheckReport) {
+	entries, err := db.fs.ReadDir(db.path)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".tmp") {
+			path := filepath.Join(db.path, e.Name())
+			report.add(db.path, Issue{Path: path, Kind: IssueTempFile,
+				Repaired: repair && db.fs.Remove(path) == nil})
+		}
+	}
+}
+
+// add - appends an issue, its path made relative to root
+func (r *CheckReport) add(root string, i Issue) {
+	if rel, err := filepath.Rel(root, i.Path); err == nil {
+		i.Path = rel
+	}
+	r.Issues = append(r.Issues, i)
+}
+
+// helper: checks one collection; mu must be held exclusively
+func (c *collection) check(root string, repair bool, report *CheckReport) error {
+	if c.store != nil {
+		return c.checkSegments(root, repair, report)
+	}
+
+	// every file of a key, in either layout
+	files := make(map[string][]string)
+	var visit func(dir string, depth int) error
+	visit = func(dir string, depth int) error {
+		entries, err := c.fs.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			name, path := e.Name(), filepath.Join(dir, e.Name())
+			switch {
+			case e.IsDir() && depth < 2 && isShardDir(e):
+				if err := visit(path, depth+1); err != nil {
+					return err
+				}
+			case e.IsDir() && (strings.HasPrefix(name, ".") || depth == 0 && name == QuarantineDir):
+				// lock files and segments of the collection, or records already quarantined
+			case e.IsDir():
+				report.add(root, Issue{Collection: c.name, Path: path, Kind: IssueStrayDir})
+			case strings.HasSuffix(name, ".tmp"):
+				report.add(root, Issue{Collection: c.name, Path: path, Kind: IssueTempFile,
+					Repaired: repair && c.fs.Remove(path) == nil})
+			default:
+				if codec, key := c.codecs.byFile(name); codec != nil {
+					report.Records++
+					if c.checkRecord(root, key, path, codec, repair, report) {
+						files[key] = append(files[key], path)
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := visit(c.path, 0); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(files))
+	for key, paths := range files {
+		if len(paths) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// the variant reads are served from wins
+		current, err, _ := c.getPathIfExist(key, nil)
+		if err != nil {
+			continue
+		}
+		for _, path := range files[key] {
+			if path == current {
+				continue
+			}
+			repaired := false
+			if repair && c.fs.Remove(path) == nil {
+				c.remember(path)
+				repaired = true
+			}
+			report.add(root, Issue{Collection: c.name, Key: key, Path: path, Kind: IssueDuplicate,
+				Detail: "superseded by " + filepath.Base(current), Repaired: repaired})
+		}
+	}
+	return nil
+}
+
+// helper: checks one record file, reporting whether it is still in place
+func (c *collection) checkRecord(root, key, path string, codec compressor, repair bool, report *CheckReport) bool {
+	raw, err := c.fs.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	kind, detail := c.checkValue(key, raw, codec)
+	if kind == IssueCorrupt {
+		if _, ok := c.adoptEdit(key, path, raw, codec); ok {
+			return true
+		}
+	}
+	if kind == "" {
+		return true
+	}
+	issue := Issue{Collection: c.name, Key: key, Path: path, Kind: kind, Detail: detail}
+	if repair && kind != IssueUnreadable {
+		c.quarantine(path, raw)
+		_, err := c.fs.Stat(path)
+		issue.Repaired = os.IsNotExist(err)
+	}
+	report.add(root, issue)
+	return !issue.Repaired
+}
+
+// helper: the kind of issue of a stored value, empty when it is sound or can not be
+// verified without its key
+func (c *collection) checkValue(key string, data []byte, codec compressor) (string, string) {
+	value, err := c.decode(key, data, codec)
+	switch {
+	case errors.Is(err, ErrNoKey):
+		return "", ""
+	case errors.Is(err, ErrCorrupt):
+		return IssueCorrupt, err.Error()
+	case err != nil:
+		return IssueUnreadable, err.Error()
+	case !json.Valid(value):
+		return IssueInvalidJSON, ""
+	}
+	return "", ""
+}
+
+// helper: checks the entries and hint files of a segment collection; damaged entries
+// can not be moved out of a segment and are only reported
+func (c *collection) checkSegments(root string, repair bool, report *CheckReport) error {
+	for _, key := range c.store.list() {
+		data, flags, err := c.store.get(key)
+		if os.IsNotExist(err) {
+			continue
+		}
+		report.Records++
+		path := filepath.Join(c.path, SegmentDir)
+		if err != nil {
+			report.add(root, Issue{Collection: c.name, Key: key, Path: path, Kind: IssueCorrupt, Detail: err.Error()})
+			continue
+		}
+		if kind, detail := c.checkValue(key, data, c.segCodec(flags)); kind != "" {
+			report.add(root, Issue{Collection: c.name, Key: key, Path: path, Kind: kind, Detail: detail})
+		}
+	}
+	return c.store.checkHints(func(path, detail string, repaired bool) {
+		report.add(root, Issue{Collection: c.name, Path: path, Kind: IssueIndex, Detail: detail, Repaired: repaired})
+	}, repair)
+}
@@ -0,0 +1,140 @@
+package simplejsondb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sumMagic - starts the checksum header of the record files written by the library;
+// like sealMagic it can not begin a JSON document nor a compressed stream
+const sumMagic = "\x00SJDBSUM"
+
+// sumHeaderSize - sumMagic, the CRC-32C and the length of the payload following it
+const sumHeaderSize = len(sumMagic) + 4 + 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checksum - prefixes a record file payload with its checksum header
+func checksum(data []byte) []byte {
+	out := make([]byte, sumHeaderSize, sumHeaderSize+len(data))
+	copy(out, sumMagic)
+	binary.BigEndian.PutUint32(out[len(sumMagic):], crc32.Checksum(data, crcTable))
+	binary.BigEndian.PutUint64(out[len(sumMagic)+4:], uint64(len(data)))
+	return append(out, data...)
+}
+
+// verify - the payload of a record file after checking its header; files without one,
+// written by other tools or before checksums existed, are returned as they are
+func verify(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(sumMagic)) {
+		return data, nil
+	}
+	if len(data) < sumHeaderSize {
+		return nil, ErrChecksum
+	}
+	sum := binary.BigEndian.Uint32(data[len(sumMagic):])
+	size := binary.BigEndian.Uint64(data[len(sumMagic)+4:])
+	payload := data[sumHeaderSize:]
+	if uint64(len(payload)) != size {
+		return nil, fmt.Errorf("%w: %d of %d bytes", ErrChecksum, len(payload), size)
+	}
+	if crc32.Checksum(payload, crcTable) != sum {
+		return nil, ErrChecksum
+	}
+	return payload, nil
+}
+
+// corrupt - the error of a record whose stored bytes are damaged
+func corrupt(key string, err error) error {
+	return fmt.Errorf("%w: %s: %w", ErrCorrupt, key, err)
+}
+
+// editedValue - the value of a plain record file failing its checksum only because its
+// JSON was edited by hand, header left in place; ok is false for anything else
+func (c *collection) editedValue(raw []byte, codec compressor) (value []byte, ok bool) {
+	if _, plain := codec.(plainCodec); !plain || c.meta.Sealed {
+		return nil, false
+	}
+	if !bytes.HasPrefix(raw, []byte(sumMagic)) || len(raw) < sumHeaderSize {
+		return nil, false
+	}
+	value = raw[sumHeaderSize:]
+	return value, json.Valid(value)
+}
+
+// adoptEdit - the value of the corrupt record file filename, read as raw, when the
+// watcher tells it was edited from outside the library rather than damaged; the file
+// gets a header matching the edit and the change is published like the watcher would
+func (c *collection) adoptEdit(key, filename string, raw []byte, codec compressor) ([]byte, bool) {
+	if !c.changedOutside(filename) {
+		return nil, false
+	}
+	value, ok := c.editedValue(raw, codec)
+	if !ok {
+		return nil, false
+	}
+	if c.reseal(key, filename, raw, value) {
+		c.publish(key, OpCreate, value)
+	}
+	return value, true
+}
+
+// reseal - rewrites the record file filename, unless it changed from raw meanwhile,
+// with a header matching value; reports whether it did
+func (c *collection) reseal(key, filename string, raw, value []byte) bool {
+	if c.readOnly {
+		return false
+	}
+	unlock, err := c.lockForWrite(key, nil)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+	if current, err := c.fs.ReadFile(filename); err != nil || !bytes.Equal(current, raw) {
+		return false
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := c.fs.WriteFile(tmp, checksum(value), os.ModePerm); err != nil {
+		log.Printf("reseal %s: %v", filename, err)
+		return false
+	}
+	if err := c.fs.Rename(tmp, filename); err != nil {
+		c.fs.Remove(tmp)
+		log.Printf("reseal %s: %v", filename, err)
+		return false
+	}
+	c.remember(filename)
+	return true
+}
+
+// quarantine - moves the corrupt record file filename, read as data, to QuarantineDir of
+// the collection so it is no longer served. A file rewritten since it was read is left.
+func (c *collection) quarantine(filename string, data []byte) {
+	if c.readOnly {
+		return
+	}
+	if current, err := c.fs.ReadFile(filename); err != nil || !bytes.Equal(current, data) {
+		return
+	}
+	dir := filepath.Join(c.path, QuarantineDir)
+	if err := mkdirAll(c.fs, dir); err != nil {
+		log.Printf("quarantine %s: %v", filename, err)
+		return
+	}
+	dst := filepath.Join(dir, filepath.Base(filename))
+	if _, err := c.fs.Stat(dst); err == nil {
+		dst = fmt.Sprintf("%s.%d", dst, time.Now().UnixNano())
+	}
+	if err := c.fs.Rename(filename, dst); err != nil {
+		log.Printf("quarantine %s: %v", filename, err)
+		return
+	}
+	c.remember(filename)
+}
@@ -0,0 +1,150 @@
+// sjdb - maintenance commands for simple-json-db databases
+//
+//	sjdb migrate -db database1 -collection collection1 -compression zstd
+//	sjdb check -db database1 -repair
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "migrate":
+		err = migrate(os.Args[2:])
+	case "check":
+		err = check(os.Args[2:])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "sjdb:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sjdb <command> [flags]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	fmt.Fprintln(os.Stderr, "  migrate   rewrite the records of a collection in another compression or layout")
+	fmt.Fprintln(os.Stderr, "  check     audit a database and optionally repair it")
+}
+
+// readOptions - options carrying the zstd dictionary and the keys of the given files
+func readOptions(dictFile, keyFile string) (opts simplejsondb.Options, err error) {
+	if dictFile != "" {
+		if opts.ZstdDictionary, err = os.ReadFile(dictFile); err != nil {
+			return opts, err
+		}
+	}
+	if keyFile != "" {
+		if opts.Encryption, err = simplejsondb.NewKeyFile(keyFile); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// migrate - rewrites a collection, printing the progress
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	name := fs.String("collection", "", "collection to migrate")
+	compression := fs.String("compression", simplejsondb.CompressionNone, "target compression: none, gzip, zstd or snappy")
+	level := fs.Int("level", 0, "compression level, the codec default when zero")
+	minSize := fs.Int("min-size", 0, "store payloads smaller than this uncompressed")
+	layout := fs.String("layout", "", "target layout: flat or sharded, unchanged when empty")
+	dictFile := fs.String("dict", "", "zstd dictionary file")
+	keyFile := fs.String("keys", "", "key file of an encrypted collection, records are sealed with its last key")
+	quiet := fs.Bool("q", false, "do not report progress")
+	fs.Parse(args)
+	if *dbPath == "" || *name == "" {
+		fs.Usage()
+		return fmt.Errorf("-db and -collection are required")
+	}
+
+	opts, err := readOptions(*dictFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	opts.CompressionLevel = *level
+	db, err := simplejsondb.New(*dbPath, &opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	c, err := db.Collection(*name)
+	if err != nil {
+		return err
+	}
+
+	var last simplejsondb.MigrateProgress
+	err = c.Migrate(simplejsondb.Options{Compression: *compression, CompressMinSize: *minSize, Layout: *layout},
+		func(p simplejsondb.MigrateProgress) {
+			last = p
+			if !*quiet && (p.Rewritten+p.Skipped)%1000 == 0 {
+				fmt.Printf("%d/%d records\n", p.Rewritten+p.Skipped, p.Total)
+			}
+		})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("migrated %s: %d rewritten, %d already in the target format\n", *name, last.Rewritten, last.Skipped)
+	return nil
+}
+
+// check - audits a database, printing every issue; it fails while issues remain
+func check(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	dbPath := fs.String("db", "", "database directory")
+	name := fs.String("collection", "", "collection to check, all when empty")
+	repair := fs.Bool("repair", false, "quarantine damaged records, remove duplicates and temporary files, rebuild hint files")
+	dictFile := fs.String("dict", "", "zstd dictionary file")
+	keyFile := fs.String("keys", "", "key file of encrypted collections")
+	fs.Parse(args)
+	if *dbPath == "" {
+		fs.Usage()
+		return fmt.Errorf("-db is required")
+	}
+
+	opts, err := readOptions(*dictFile, *keyFile)
+	if err != nil {
+		return err
+	}
+	opts.ReadOnly = !*repair
+	db, err := simplejsondb.New(*dbPath, &opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var checkOpts simplejsondb.CheckOptions
+	checkOpts.Repair = *repair
+	if *name != "" {
+		checkOpts.Collections = []string{*name}
+	}
+	report, err := db.Check(checkOpts)
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		fmt.Println(issue)
+	}
+	fmt.Printf("checked %d collections, %d records: %d issues\n", report.Collections, report.Records, len(report.Issues))
+	if !report.OK() && *repair {
+		return fmt.Errorf("issues remain which need a manual repair")
+	}
+	if !report.OK() {
+		return fmt.Errorf("issues remain, run with -repair to fix them")
+	}
+	return nil
+}
@@ -1,154 +1,389 @@
 package simplejsondb
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
-// GetAll - returns all records
+// GetAll - returns all records; corrupt ones are skipped and quarantined
 func (c *collection) GetAll() (data [][]byte) {
-	records, err := os.ReadDir(c.path)
-	if err != nil {
-		return
-	}
-	for _, r := range records {
-		if !r.IsDir() {
-			fPath := filepath.Join(c.path, r.Name())
-			record, err := os.ReadFile(fPath)
-			if err != nil {
-				continue // skipping a file which has issue
-			}
-
-			if strings.LastIndex(r.Name(), GZipExt) > 0 {
-				record, _ = UnGzip(record) // skipping ungip error over mutli file fetch
-			}
-
-			data = append(data, record)
-		}
-	}
+	c.each(func(_ string, record []byte) {
+		data = append(data, record)
+	})
 	return
 }
 
 // GetAllByName - returns all records
 func (c *collection) GetAllByName() (data map[string][]byte) {
 	data = make(map[string][]byte)
+	c.each(func(name string, record []byte) {
+		data[name] = record
+	})
+	return
+}
 
-	records, err := os.ReadDir(c.path)
-	if err != nil {
+// helper: calls fn with the name and value of every readable record, moving the corrupt
+// record files to QuarantineDir
+func (c *collection) each(fn func(name string, record []byte)) {
+	if c.dropped.Load() {
 		return
 	}
-	for _, r := range records {
-		if !r.IsDir() {
-			fPath := filepath.Join(c.path, r.Name())
-			record, err := os.ReadFile(fPath)
-			if err != nil {
-				continue // skipping a file which has issue
+	if c.store != nil {
+		c.store.each(func(key string, record []byte, flags byte) {
+			if record, err := c.decode(key, record, c.segCodec(flags)); err == nil {
+				fn(key, record)
 			}
+		})
+		return
+	}
+	c.walk(func(dir string, r os.DirEntry) {
+		fPath := filepath.Join(dir, r.Name())
+		raw, err := c.fs.ReadFile(fPath)
+		if err != nil {
+			return // skipping a file which has issue
+		}
 
-			if strings.LastIndex(r.Name(), GZipExt) > 0 {
-				record, _ = UnGzip(record) // skipping ungip error over mutli file fetch
+		record := raw
+		if codec, key := c.codecs.byFile(r.Name()); codec != nil {
+			if record, err = c.decode(key, raw, codec); err != nil {
+				if !errors.Is(err, ErrCorrupt) {
+					return // skipping a record which can not be read over mutli file fetch
+				}
+				var ok bool
+				if record, ok = c.adoptEdit(key, fPath, raw, codec); !ok {
+					c.quarantine(fPath, raw)
+					return
+				}
 			}
+		}
+
+		fn(strings.TrimSuffix(r.Name(), Ext), record)
+	})
+}
+
+// Get help to retrive key based record; a damaged record returns ErrCorrupt and its
+// file is moved to QuarantineDir
+func (c *collection) Get(key string, options ...Options) (data []byte, err error) {
+	release, err := c.lockRecord(key, ModeRead, options)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
-			name := strings.TrimSuffix(r.Name(), Ext)
-			data[name] = record
+	if c.store != nil {
+		var flags byte
+		data, flags, err = c.store.get(key)
+		if errors.Is(err, ErrChecksum) {
+			return nil, corrupt(key, err)
+		}
+		if err != nil {
+			return nil, err
 		}
+		return c.decode(key, data, c.segCodec(flags))
 	}
-	return
-}
 
-// Get help to retrive key based record
-func (c *collection) Get(key string) (data []byte, err error) {
-	filename, err, isGzip := c.getPathIfExist(key, err)
-	data, err = os.ReadFile(filename)
+	filename, err, codec := c.getPathIfExist(key, err)
 	if err != nil {
-		return
+		return nil, err
+	}
+	raw, err := c.fs.ReadFile(filename)
+	if err != nil {
+		return nil, err
 	}
 
-	if isGzip {
-		_data, _err := UnGzip(data)
-		if _err != nil {
-			return _data, _err
+	data, err = c.decode(key, raw, codec)
+	if errors.Is(err, ErrCorrupt) {
+		if value, ok := c.adoptEdit(key, filename, raw, codec); ok {
+			return value, nil
 		}
-		data, err = _data, _err
+		c.quarantine(filename, raw)
 	}
 	return
 }
 
 // Create - helps to save data into model dir
 func (c *collection) Create(key string, data []byte, options ...Options) (err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	var useGzip bool = c.useGzip
-	if !c.useGzip {
-		if options != nil && options[0].UseGzip {
-			useGzip = options[0].UseGzip
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	// hidden files hold the collection's own data, see isRecord
+	if key == "" || strings.HasPrefix(key, ".") {
+		return ErrInvalidKey
+	}
+	// hooks run under the record lock, so they see the record as the write leaves it
+	release, err := c.lockRecord(key, ModeWrite, options)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	data, err = c.before(func(h *hooks) []BeforeHook { return h.beforeCreate }, key, data)
+	if err != nil {
+		return err
+	}
+	if err = c.create(key, data, options); err != nil {
+		return err
+	}
+	c.after(func(h *hooks) []AfterHook { return h.afterCreate }, key, data)
+	return nil
+}
+
+// create - writes the record; the caller holds its record lock
+func (c *collection) create(key string, data []byte, options []Options) (err error) {
+	unlock, err := c.lockForWrite(key, leaseOf(options))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	value := data
+	data, compression, err := c.encode(key, value, options)
+	if err != nil {
+		return err
+	}
+	filename := c.getFullPath(key, compression)
+	if c.store != nil {
+		if err = c.store.put(key, data, segFlags[compression]); err != nil {
+			return err
 		}
+		return c.publish(key, OpCreate, value)
 	}
-	filename := c.getFullPath(key, c.useGzip)
-	if useGzip {
-		data, err = Gzip(data)
-		if err != nil {
+	if c.layout == LayoutSharded {
+		if err = mkdirAll(c.fs, filepath.Dir(filename)); err != nil {
 			return err
 		}
 	}
-	return os.WriteFile(filename, data, os.ModePerm)
+	if err = c.fs.WriteFile(filename, data, os.ModePerm); err != nil {
+		return err
+	}
+	c.remember(filename)
+	c.removeVariants(key, filename)
+	return c.publish(key, OpCreate, value)
 }
 
-// Delete - helps to delete model dir record
-func (c *collection) Delete(key string) (err error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+// removeVariants - removes the files of key other than filename: the record written in
+// another compression, or not migrated to the current layout yet, is superseded
+func (c *collection) removeVariants(key, filename string) {
+	for _, dir := range c.recordDirs(key) {
+		for _, ext := range recordExts() {
+			stale := filepath.Join(dir, key+ext)
+			if stale != filename && c.fs.Remove(stale) == nil {
+				c.remember(stale)
+			}
+		}
+	}
+}
 
-	filename, err, _ := c.getPathIfExist(key, err)
+// encode - compresses the payload of one write of key, then seals it when the collection
+// is encrypted and prefixes a record file with its checksum, returning the compression
+// actually used
+func (c *collection) encode(key string, value []byte, options []Options) ([]byte, string, error) {
+	data, compression, err := c.compress(value, options)
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+	switch {
+	case c.keys != nil:
+		data, err = seal(c.keys, key, data)
+	case c.meta.Encryption != "":
+		err = ErrNoKey // never write plain records into an encrypted collection
+	}
+	if err != nil {
+		return nil, "", err
 	}
+	// segments checksum their entries themselves
+	if c.store == nil {
+		data = checksum(data)
+	}
+	return data, compression, nil
+}
+
+// helper: compresses the payload of one write under the compression policy
+func (c *collection) compress(value []byte, options []Options) ([]byte, string, error) {
+	compression, minSize := c.writeCompression(options)
+	codec := c.codecs.byName(compression)
+	if codec == nil {
+		return nil, "", ErrUnknownCompression
+	}
+	if minSize > 0 && len(value) < minSize {
+		return value, CompressionNone, nil
+	}
+	data, err := codec.compress(value)
+	if err != nil {
+		return nil, "", err
+	}
+	// under a size policy the compressed form has to earn its place
+	if minSize > 0 && len(data) >= len(value) {
+		return value, CompressionNone, nil
+	}
+	return data, compression, nil
+}
 
-	return os.Remove(filename)
+// decode - the value of a stored payload of key: verified, opened when sealed, then
+// decompressed. Only a failed checksum makes the record ErrCorrupt. Records written
+// before the collection was encrypted are read as they are until RotateKey has sealed
+// them all, a plain record is refused from then on.
+func (c *collection) decode(key string, data []byte, codec compressor) ([]byte, error) {
+	data, err := verify(data)
+	if err != nil {
+		return nil, corrupt(key, err)
+	}
+	if isSealed(data) {
+		if data, err = unseal(c.keys, key, data); err != nil {
+			return nil, err
+		}
+	} else if c.meta.Sealed {
+		return nil, fmt.Errorf("%w: %s is not encrypted", ErrDecrypt, key)
+	}
+	// the checksum vouches for the stored bytes, so they are not quarantined for this
+	value, err := codec.decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return value, nil
 }
 
-func (c *collection) Len() uint64 {
-	records, _ := os.ReadDir(c.path)
-	return uint64(len(records))
+// writeCompression - the compression and size threshold of one write: Options.Compression
+// of the call wins, then its UseGzip, then the collection format; a CompressMinSize passed
+// to the call replaces the database one
+func (c *collection) writeCompression(options []Options) (compression string, minSize int) {
+	compression, minSize = c.compression, c.compressMinSize
+	if len(options) == 0 {
+		return
+	}
+	switch {
+	case options[0].Compression != "":
+		compression = options[0].Compression
+	case options[0].UseGzip:
+		compression = CompressionGzip
+	}
+	if options[0].CompressMinSize > 0 {
+		minSize = options[0].CompressMinSize
+	}
+	return
 }
 
-func (c *collection) getFullPath(key string, isGzip bool) string {
-	var record string
-	if isGzip {
-		record = key + GZipExt
-	} else {
-		record = key + Ext
+// Delete - helps to delete model dir record
+func (c *collection) Delete(key string, options ...Options) (err error) {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	release, err := c.lockRecord(key, ModeWrite, options)
+	if err != nil {
+		return err
 	}
-	filename := filepath.Join(c.path, record)
+	defer release()
 
-	return filename
+	if _, err = c.before(func(h *hooks) []BeforeHook { return h.beforeDelete }, key, nil); err != nil {
+		return err
+	}
+	if err = c.delete(key, options); err != nil {
+		return err
+	}
+	c.after(func(h *hooks) []AfterHook { return h.afterDelete }, key, nil)
+	return nil
 }
 
-func (c *collection) getPathIfExist(key string, err error) (string, error, bool) {
-	record := key + Ext
-	filename := filepath.Join(c.path, record)
+// delete - removes the record; the caller holds its record lock
+func (c *collection) delete(key string, options []Options) (err error) {
+	unlock, err := c.lockForWrite(key, leaseOf(options))
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
-	if success, err := c.isExist(filename, err); !success {
-		record = key + GZipExt
-		filename = filepath.Join(c.path, record)
-		if success, err := c.isExist(filename, err); !success {
-			return "", err, false
+	if c.store != nil {
+		if !c.store.has(key) {
+			return os.ErrNotExist
+		}
+		if err = c.store.put(key, nil, segTombstone); err != nil {
+			return err
 		}
+		return c.publish(key, OpDelete, nil)
+	}
 
-		return filename, nil, true
+	filename, err, _ := c.getPathIfExist(key, err)
+	if err != nil {
+		return err
 	}
 
-	return filename, nil, false
+	if err = c.fs.Remove(filename); err != nil {
+		return err
+	}
+	c.remember(filename)
+	c.removeVariants(key, filename)
+	return c.publish(key, OpDelete, nil)
 }
 
-func (c *collection) isExist(filename string, err error) (bool, error) {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false, err
+func (c *collection) Len() (total uint64) {
+	if c.dropped.Load() {
+		return 0
 	}
-	if !info.IsDir() {
-		return true, nil
+	if c.store != nil {
+		return uint64(c.store.len())
 	}
-	return false, nil
+	c.walk(func(string, os.DirEntry) {
+		total++
+	})
+	return
+}
+
+// Meta returns the persisted collection metadata
+func (c *collection) Meta() Metadata {
+	return *c.meta
+}
+
+// isRecord - reports whether a directory entry holds a record; hidden files such as MetaFile are skipped
+func isRecord(r os.DirEntry) bool {
+	return !r.IsDir() && !strings.HasPrefix(r.Name(), ".")
+}
+
+func (c *collection) getFullPath(key string, compression string) string {
+	record := key + Ext
+	if codec := c.codecs.byName(compression); codec != nil {
+		record = key + codec.ext()
+	}
+	filename := filepath.Join(c.recordDir(key, c.layout), record)
+
+	return filename
+}
+
+// getPathIfExist - the record file of key, in whichever layout and compression it was written.
+// The file in the current layout and compression is looked for first, as most records are
+// stored that way; the other variants are only probed without it. Writes remove the other
+// variants of a record; should several be left behind anyway, by an interrupted write or an
+// outside copy, the most recently modified one wins.
+func (c *collection) getPathIfExist(key string, err error) (string, error, compressor) {
+	if codec := c.codecs.byName(c.compression); codec != nil {
+		filename := c.getFullPath(key, c.compression)
+		if info, serr := c.fs.Stat(filename); serr == nil && !info.IsDir() {
+			return filename, nil, codec
+		}
+	}
+	for _, dir := range c.recordDirs(key) {
+		var found string
+		var codec compressor
+		var modTime time.Time
+		for _, ext := range recordExts() {
+			filename := filepath.Join(dir, key+ext)
+
+			info, serr := c.fs.Stat(filename)
+			if serr != nil {
+				err = serr
+				continue
+			}
+			if !info.IsDir() && (found == "" || info.ModTime().After(modTime)) {
+				found, codec, modTime = filename, c.codecs.byExt(ext), info.ModTime()
+			}
+		}
+		if found != "" {
+			return found, nil, codec
+		}
+	}
+
+	return "", err, nil
 }
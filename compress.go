@@ -0,0 +1,190 @@
+package simplejsondb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor - one way of storing the bytes of a record file, recognised by its extension
+type compressor interface {
+	ext() string
+	compress(data []byte) ([]byte, error)
+	decompress(data []byte) ([]byte, error)
+}
+
+// codecs - the compressors of a database by compression name, configured from Options
+type codecs map[string]compressor
+
+// compressionOf - the compression chosen by options, CompressionGzip also through UseGzip
+func compressionOf(opts Options) string {
+	switch {
+	case opts.Compression != "":
+		return opts.Compression
+	case opts.UseGzip:
+		return CompressionGzip
+	}
+	return CompressionNone
+}
+
+// newCodecs - builds the compressors with the configured level and zstd dictionary
+func newCodecs(opts Options) (codecs, error) {
+	level := gzipLevel(opts.CompressionLevel)
+	if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+		if compressionOf(opts) == CompressionGzip {
+			return nil, err
+		}
+		level = gzip.DefaultCompression // the level is meant for another codec
+	}
+	encOpts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	decOpts := []zstd.DOption{zstd.WithDecoderConcurrency(0)}
+	if opts.CompressionLevel != 0 {
+		encOpts = append(encOpts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(opts.CompressionLevel)))
+	}
+	var dictID uint32
+	if opts.ZstdDictionary != nil {
+		info, err := zstd.InspectDictionary(opts.ZstdDictionary)
+		if err != nil {
+			return nil, err
+		}
+		dictID = info.ID()
+		encOpts = append(encOpts, zstd.WithEncoderDict(opts.ZstdDictionary))
+		decOpts = append(decOpts, zstd.WithDecoderDicts(opts.ZstdDictionary))
+	}
+	enc, err := zstd.NewWriter(nil, encOpts...)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := zstd.NewReader(nil, decOpts...)
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+	return codecs{
+		CompressionNone:   plainCodec{},
+		CompressionGzip:   gzipCodec{level: level},
+		CompressionZstd:   zstdCodec{enc: enc, dec: dec, dict: dictID},
+		CompressionSnappy: snappyCodec{},
+	}, nil
+}
+
+// dictionary - the ID of the zstd dictionary of the codecs, zero without one
+func (cs codecs) dictionary() uint32 {
+	if z, ok := cs[CompressionZstd].(zstdCodec); ok {
+		return z.dict
+	}
+	return 0
+}
+
+// close - releases the zstd encoder and the goroutines of the decoder
+func (cs codecs) close() error {
+	z, ok := cs[CompressionZstd].(zstdCodec)
+	if !ok {
+		return nil
+	}
+	z.dec.Close()
+	return z.enc.Close()
+}
+
+// byName - the compressor of a compression name, nil when unknown
+func (cs codecs) byName(name string) compressor {
+	return cs[name]
+}
+
+// byFile - the compressor which wrote a record file and the key it holds, nil for other files
+func (cs codecs) byFile(name string) (compressor, string) {
+	if strings.HasPrefix(name, ".") {
+		return nil, ""
+	}
+	for _, ext := range recordExts() {
+		if strings.HasSuffix(name, ext) {
+			return cs.byExt(ext), strings.TrimSuffix(name, ext)
+		}
+	}
+	return nil, ""
+}
+
+func (cs codecs) byExt(ext string) compressor {
+	for _, c := range cs {
+		if c.ext() == ext {
+			return c
+		}
+	}
+	return nil
+}
+
+// recordExts - the extensions of record files, in the order reads probe them
+func recordExts() []string {
+	return []string{Ext, GZipExt, ZstdExt, SnappyExt}
+}
+
+// TrainZstdDictionary - builds a zstd dictionary of at most size bytes from sample
+// records, to be passed as Options.ZstdDictionary; small records compress far better with it
+func TrainZstdDictionary(samples [][]byte, size int) ([]byte, error) {
+	return dict.BuildZstdDict(samples, dict.Options{MaxDictSize: size, HashBytes: 6})
+}
+
+type plainCodec struct{}
+
+func (plainCodec) ext() string                            { return Ext }
+func (plainCodec) compress(data []byte) ([]byte, error)   { return data, nil }
+func (plainCodec) decompress(data []byte) ([]byte, error) { return data, nil }
+
+type gzipCodec struct {
+	level int
+}
+
+func gzipLevel(level int) int {
+	if level == 0 {
+		return gzip.DefaultCompression
+	}
+	return level
+}
+
+func (gzipCodec) ext() string { return GZipExt }
+
+func (g gzipCodec) compress(data []byte) ([]byte, error) {
+	if g.level == gzip.DefaultCompression {
+		return Gzip(data)
+	}
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, g.level)
+	if err != nil {
+		return data, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return data, err
+	}
+	err = writer.Close()
+	return buffer.Bytes(), err
+}
+
+func (gzipCodec) decompress(data []byte) ([]byte, error) { return UnGzip(data) }
+
+// zstdCodec - EncodeAll and DecodeAll may be used concurrently
+type zstdCodec struct {
+	enc  *zstd.Encoder
+	dec  *zstd.Decoder
+	dict uint32 // ID of the dictionary, zero without one
+}
+
+func (zstdCodec) ext() string { return ZstdExt }
+
+func (z zstdCodec) compress(data []byte) ([]byte, error) {
+	return z.enc.EncodeAll(data, nil), nil
+}
+
+func (z zstdCodec) decompress(data []byte) ([]byte, error) {
+	return z.dec.DecodeAll(data, nil)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ext() string                            { return SnappyExt }
+func (snappyCodec) compress(data []byte) ([]byte, error)   { return snappy.Encode(nil, data), nil }
+func (snappyCodec) decompress(data []byte) ([]byte, error) { return snappy.Decode(nil, data) }
@@ -2,8 +2,63 @@ package simplejsondb
 
 import "errors"
 
+// FormatVersion - on-disk format version written into metadata files.
+//
+//	1: record files hold the (compressed) JSON document as it is
+//	2: record files start with a 20 byte binary checksum header, "\x00SJDBSUM", the
+//	   CRC-32C and the length of the rest, both big-endian, so a .json file is no longer
+//	   plain JSON; files without the header are still read
+const FormatVersion = 2
+
+// Codec and compression names recorded in metadata
+const (
+	CodecJSON       = "json"
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	// CompressionZstd compresses with Zstandard, optionally with a trained dictionary.
+	CompressionZstd = "zstd"
+	// CompressionSnappy favours speed over size.
+	CompressionSnappy = "snappy"
+)
+
+// EncryptionAESGCM - encryption of the records of a collection, recorded in metadata
+const EncryptionAESGCM = "aes-gcm"
+
 var (
-	Ext            string = ".json"
-	GZipExt        string = ".json.gz"
-	ErrNoDirectory error  = errors.New("not a directory")
+	Ext                    string = ".json"
+	GZipExt                string = ".json.gz"
+	ZstdExt                string = ".json.zst"
+	SnappyExt              string = ".json.sz"
+	MetaFile               string = ".meta.json"
+	LockFile               string = ".lock"
+	LockDir                string = ".locks"
+	ChangeLogFile          string = ".changes.log"
+	ChangeLogPrevFile      string = ".changes.log.1"
+	OplogDir               string = ".oplog"
+	OplogExt               string = ".log"
+	SegmentDir             string = ".segments"
+	SegmentExt             string = ".seg"
+	HintExt                string = ".hint"
+	QuarantineDir          string = "_quarantine"
+	ManifestFile           string = ".snapshot.json"
+	ErrNoDirectory         error  = errors.New("not a directory")
+	ErrIncompatibleOptions error  = errors.New("incompatible options")
+	ErrReadOnly            error  = errors.New("database is read-only")
+	ErrLockBusy            error  = errors.New("lock is held")
+	ErrNotOwner            error  = errors.New("lock is not held under this token")
+	ErrDeadlock            error  = errors.New("deadlock detected")
+	ErrLeaseMode           error  = errors.New("lease mode does not allow this operation")
+	ErrHookPanic           error  = errors.New("hook panicked")
+	ErrNoPayload           error  = errors.New("oplog entry carries no payload")
+	ErrUnknownLayout       error  = errors.New("unknown layout")
+	ErrUnknownEngine       error  = errors.New("unknown storage engine")
+	ErrUnknownCompression  error  = errors.New("unknown compression")
+	ErrNotSupported        error  = errors.New("not supported by the storage engine")
+	ErrChecksum            error  = errors.New("checksum mismatch")
+	ErrNoKey               error  = errors.New("encryption key not available")
+	ErrDecrypt             error  = errors.New("record cannot be decrypted")
+	ErrCorrupt             error  = errors.New("record is corrupt")
+	ErrInvalidKey          error  = errors.New("invalid record key")
+	ErrChangesPruned       error  = errors.New("change log no longer reaches back to the resume token")
+	ErrDropped             error  = errors.New("collection was dropped, open it again")
 )
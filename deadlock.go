@@ -0,0 +1,111 @@
+package simplejsondb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// waiter - an owner blocked on a record lock, an edge source of the wait-for graph
+type waiter struct {
+	owner string
+	id    string
+	mode  LockMode
+}
+
+// DeadlockError - a lock request which would close a cycle in the wait-for graph.
+// It matches ErrDeadlock with errors.Is.
+type DeadlockError struct {
+	IDs    []string // records along the cycle, starting with the one requested
+	Owners []string // owners along the cycle, starting with the requester
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("%v: owners %s waiting on each other over IDs %s",
+		ErrDeadlock, strings.Join(e.Owners, " -> "), strings.Join(e.IDs, ", "))
+}
+
+func (e *DeadlockError) Unwrap() error {
+	return ErrDeadlock
+}
+
+// helper: registers owner as waiting for id unless that closes a cycle; recMu must be held
+func (c *collection) wait(owner, id string, mode LockMode) (*waiter, error) {
+	w := &waiter{owner: owner, id: id, mode: mode}
+	if cycle := c.findCycle(w); cycle != nil {
+		return nil, cycle
+	}
+	if c.recWaits == nil {
+		c.recWaits = make(map[*waiter]struct{})
+	}
+	c.recWaits[w] = struct{}{}
+	return w, nil
+}
+
+// helper: removes a wait-for edge once the wait is over; recMu must be held
+func (c *collection) unwait(w *waiter) {
+	delete(c.recWaits, w)
+}
+
+// helper: owners a request for id in mode has to wait for: conflicting holders
+// and writers queued ahead of it; recMu must be held
+func (c *collection) blockers(w *waiter) (owners []string) {
+	seen := map[string]bool{}
+	add := func(owner string) {
+		if !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+	for _, ls := range c.recLeases {
+		if ls.ID == w.id && (w.mode != ModeRead || ls.Mode != ModeRead) {
+			add(ls.Owner)
+		}
+	}
+	for other := range c.recWaits {
+		if other != w && other.id == w.id && other.mode != ModeRead {
+			add(other.owner)
+		}
+	}
+	return
+}
+
+// helper: depth first search for a path from the blockers of w back to its owner; recMu must be held
+func (c *collection) findCycle(w *waiter) *DeadlockError {
+	visited := map[string]bool{}
+	var path []*waiter
+	var visit func(w *waiter) bool
+	visit = func(w *waiter) bool {
+		path = append(path, w)
+		for _, owner := range c.blockers(w) {
+			if owner == path[0].owner {
+				return true
+			}
+			if visited[owner] {
+				continue
+			}
+			visited[owner] = true
+			for next := range c.recWaits {
+				if next.owner == owner && visit(next) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if !visit(w) {
+		return nil
+	}
+	e := &DeadlockError{}
+	for _, p := range path {
+		e.IDs = append(e.IDs, p.id)
+		e.Owners = append(e.Owners, p.owner)
+	}
+	return e
+}
+
+// anonymousOwner - the owner of locks taken without LockOptions.Owner: unique to the
+// request, so it never waits while holding another lock and closes no cycle
+func (c *collection) anonymousOwner() string {
+	return fmt.Sprintf("anonymous-%d", c.anonymous.Add(1))
+}
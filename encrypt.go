@@ -0,0 +1,244 @@
+package simplejsondb
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// KeyProvider - supplies the AES keys (16, 24 or 32 bytes) encrypting the records of a
+// collection. Each record names the key it was sealed with, so retired keys must stay
+// available until RotateKey has rewritten the records using them.
+type KeyProvider interface {
+	// CurrentKey - the ID and key new records are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key - the key with the ID found in a record header
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys - keys held in memory; Rotate makes a new key current while the previous
+// ones keep decrypting older records
+type StaticKeys struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+}
+
+// NewStaticKeys - a provider whose current key is key, known by id
+func NewStaticKeys(id string, key []byte) (*StaticKeys, error) {
+	s := &StaticKeys{}
+	return s, s.Rotate(id, key)
+}
+
+// Rotate - adds key under id and makes it the current key
+func (s *StaticKeys) Rotate(id string, key []byte) error {
+	if err := checkKey(id, key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string][]byte)
+	}
+	s.keys[id], s.current = key, id
+	return nil
+}
+
+// CurrentKey - the ID and key new records are encrypted with
+func (s *StaticKeys) CurrentKey() (string, []byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.current, s.keys[s.current], nil
+}
+
+// Key - the key known by id
+func (s *StaticKeys) Key(id string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok := s.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrNoKey, id)
+}
+
+// KeyFile - keys read from a file for local setups, one "<id> <base64 key>" per line,
+// blank lines and lines starting with # being ignored. The last key is the current one,
+// so a key is rotated by appending a line and calling Reload.
+type KeyFile struct {
+	path string
+	keys *StaticKeys
+	mu   sync.RWMutex
+}
+
+// NewKeyFile - a provider of the keys in the file path
+func NewKeyFile(path string) (*KeyFile, error) {
+	k := &KeyFile{path: path}
+	return k, k.Reload()
+}
+
+// Reload - reads the key file again
+func (k *KeyFile) Reload() error {
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	keys := &StaticKeys{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want \"<id> <base64 key>\"", k.path, n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", k.path, n, err)
+		}
+		if err := keys.Rotate(fields[0], key); err != nil {
+			return fmt.Errorf("%s:%d: %w", k.path, n, err)
+		}
+	}
+	if keys.current == "" {
+		return fmt.Errorf("%w: %s holds no key", ErrNoKey, k.path)
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// CurrentKey - the last key of the file
+func (k *KeyFile) CurrentKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys.CurrentKey()
+}
+
+// Key - the key of the file known by id
+func (k *KeyFile) Key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.keys.Key(id)
+}
+
+// sameKeys - reports whether two providers are the same one, without panicking on
+// providers of an uncomparable type
+func sameKeys(a, b KeyProvider) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return reflect.TypeOf(a) == reflect.TypeOf(b) && reflect.TypeOf(a).Comparable() && a == b
+}
+
+// helper: validates a key and its ID, which has to fit the record header
+func checkKey(id string, key []byte) error {
+	if id == "" || len(id) > 255 || strings.ContainsAny(id, " \t\r\n") {
+		return fmt.Errorf("%w: invalid key id %q", ErrNoKey, id)
+	}
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("%w: key %q: %v", ErrNoKey, id, err)
+	}
+	return nil
+}
+
+// sealMagic - starts every encrypted record; no JSON document nor compressed stream
+// begins with a NUL byte followed by it
+const sealMagic = "\x00SJDBAES"
+
+// sealed record: sealMagic | id length (1 byte) | key id | nonce | AES-GCM ciphertext and tag.
+// The header and the record key are authenticated along with the payload, so a record
+// can neither be relabelled nor moved to another key unnoticed.
+
+// seal - encrypts a stored payload of record key under the current key of keys
+func seal(keys KeyProvider, key string, data []byte) ([]byte, error) {
+	id, secret, err := keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkKey(id, secret); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(sealMagic)+1+len(id)+aead.NonceSize())
+	header = append(header, sealMagic...)
+	header = append(header, byte(len(id)))
+	header = append(header, id...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, data, sealAAD(out[:len(out)-len(nonce)], key)), nil
+}
+
+// unseal - decrypts a payload written by seal
+func unseal(keys KeyProvider, key string, data []byte) ([]byte, error) {
+	id, ok := sealedKeyID(data)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("%w: %q", ErrNoKey, id)
+	}
+	secret, err := keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(secret)
+	if err != nil {
+		return nil, err
+	}
+	headerLen := len(sealMagic) + 1 + len(id)
+	if len(data) < headerLen+aead.NonceSize()+aead.Overhead() {
+		return nil, ErrDecrypt
+	}
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerLen+aead.NonceSize():], sealAAD(data[:headerLen], key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrDecrypt, key)
+	}
+	return plain, nil
+}
+
+// isSealed - reports whether a stored payload was encrypted
+func isSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(sealMagic))
+}
+
+// sealedKeyID - the ID of the key a sealed payload was encrypted with
+func sealedKeyID(data []byte) (string, bool) {
+	if !isSealed(data) || len(data) < len(sealMagic)+1 {
+		return "", false
+	}
+	n := int(data[len(sealMagic)])
+	if len(data) < len(sealMagic)+1+n {
+		return "", false
+	}
+	return string(data[len(sealMagic)+1 : len(sealMagic)+1+n]), true
+}
+
+func sealAAD(header []byte, key string) []byte {
+	return append(append([]byte{}, header...), key...)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
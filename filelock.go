@@ -0,0 +1,234 @@
+package simplejsondb
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// filePollInterval - how often a context bound acquisition retries a busy OS lock
+const filePollInterval = 10 * time.Millisecond
+
+// fileLock - an advisory OS lock held on a lock file
+type fileLock struct {
+	f    *os.File
+	path string // removed on unlock when no other process holds it, see lockKey
+}
+
+// lockFile - opens (or creates) the lock file at path and waits until the OS lock is held
+// or ctx is done. Read-only databases never create lock files, and a database on another
+// FS than OSFS cannot be shared with other processes, so it takes no OS locks.
+func lockFile(ctx context.Context, fsys FS, path string, exclusive, readOnly bool) (*fileLock, error) {
+	if !isOS(fsys) {
+		return &fileLock{}, nil
+	}
+	var f *os.File
+	var err error
+	if readOnly {
+		f, err = os.Open(path)
+	} else {
+		if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return nil, err
+		}
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o666)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := waitFlock(ctx, f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileLock{f: f}, nil
+}
+
+// waitFlock - blocks in flock when ctx can never be done, polls otherwise
+func waitFlock(ctx context.Context, f *os.File, exclusive bool) error {
+	if ctx.Done() == nil {
+		return flock(f, exclusive)
+	}
+	for {
+		ok, err := tryFlock(f, exclusive)
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(filePollInterval):
+		}
+	}
+}
+
+// unlock - releases the OS lock and closes the lock file
+func (l *fileLock) unlock() error {
+	if l.f == nil {
+		return nil
+	}
+	// only the sole holder may remove the file, others locking it meanwhile open it anew
+	if l.path != "" {
+		if ok, _ := tryFlock(l.f, true); ok && l.current() {
+			os.Remove(l.path)
+		}
+	}
+	err := funlock(l.f)
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// current - reports whether the locked file is still the one at its path
+func (l *fileLock) current() bool {
+	info, err := l.f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(l.path)
+	return err == nil && os.SameFile(info, cur)
+}
+
+// lockKey - takes the OS lock on the lock file of a record. Record lock files only exist
+// while held, so a file removed between opening and locking it is opened again, and a
+// read-only database finding none has nothing to wait for.
+func (c *collection) lockKey(ctx context.Context, id string, exclusive bool) (*fileLock, error) {
+	path := c.recordLockPath(id)
+	for {
+		l, err := lockFile(ctx, c.fs, path, exclusive, c.readOnly)
+		if c.readOnly && errors.Is(err, fs.ErrNotExist) {
+			return &fileLock{}, nil
+		}
+		if err != nil || l.f == nil {
+			return l, err
+		}
+		l.path = path
+		if l.current() {
+			if c.readOnly {
+				l.path = ""
+			}
+			return l, nil
+		}
+		l.path = ""
+		l.unlock()
+	}
+}
+
+// lockForWrite - takes the inter-process locks a write to key needs: shared on the
+// database and the collection, exclusive on the record. The record level is skipped
+// when the write runs under the caller's own lease taken with ScopeInterProcess,
+// which holds it already, and for the segment engine, whose segments only one
+// process writes.
+func (c *collection) lockForWrite(key string, lease *Lease) (unlock func(), err error) {
+	var held []*fileLock
+	unlock = func() {
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].unlock()
+		}
+	}
+	for _, p := range []string{filepath.Join(filepath.Dir(c.path), LockFile), filepath.Join(c.path, LockFile)} {
+		l, err := lockFile(context.Background(), c.fs, p, false, c.readOnly)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	if c.store == nil && !c.holdsFile(key, lease) {
+		l, err := c.lockKey(context.Background(), key, true)
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return unlock, nil
+}
+
+// helper: reports whether lease is held on key along with its inter-process lock
+func (c *collection) holdsFile(key string, lease *Lease) bool {
+	if lease == nil {
+		return false
+	}
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	ls := c.recLeases[lease.Token]
+	return ls != nil && ls.ID == key && ls.file
+}
+
+// recordFile - the inter-process lock of a record, shared by the leases of this
+// process holding it with ScopeInterProcess
+type recordFile struct {
+	l       *fileLock
+	holders int
+	ready   chan struct{} // closed once the first holder took the lock or gave up
+	failed  bool          // the first holder gave up, set before ready is closed
+}
+
+// lockRecordFile - takes the inter-process lock for a record locked through LockID.
+// Holders of a record within this process are readers only or a single writer, so
+// a lock already held, or being taken, has the mode a new holder needs and is shared;
+// it is released with the last holder, never handed over to the next one. Only the
+// holders of the same record wait for each other, and each within its own ctx.
+func (c *collection) lockRecordFile(ctx context.Context, id string, mode LockMode) error {
+	for {
+		c.recMu.Lock()
+		rf := c.recFiles[id]
+		if rf == nil {
+			rf = &recordFile{holders: 1, ready: make(chan struct{})}
+			if c.recFiles == nil {
+				c.recFiles = make(map[string]*recordFile)
+			}
+			c.recFiles[id] = rf
+			c.recMu.Unlock()
+
+			l, err := c.lockKey(ctx, id, mode != ModeRead)
+			c.recMu.Lock()
+			if err != nil {
+				delete(c.recFiles, id)
+				rf.failed = true
+			}
+			rf.l = l
+			close(rf.ready)
+			c.recMu.Unlock()
+			return err
+		}
+		rf.holders++
+		c.recMu.Unlock()
+
+		select {
+		case <-rf.ready:
+			if !rf.failed {
+				return nil
+			}
+			// the first holder gave up within its own ctx, take the lock anew
+		case <-ctx.Done():
+			c.recMu.Lock()
+			if c.recFiles[id] == rf {
+				c.unlockRecordFile(id)
+			}
+			c.recMu.Unlock()
+			return ctx.Err()
+		}
+	}
+}
+
+// unlockRecordFile - drops a share of the inter-process lock for a record, releasing
+// it once no lease of this process holds it. recMu must be held by the caller.
+func (c *collection) unlockRecordFile(id string) error {
+	rf := c.recFiles[id]
+	if rf == nil {
+		return nil
+	}
+	if rf.holders--; rf.holders > 0 {
+		return nil
+	}
+	delete(c.recFiles, id)
+	return rf.l.unlock()
+}
+
+func (c *collection) recordLockPath(id string) string {
+	return filepath.Join(c.path, LockDir, id+LockFile)
+}
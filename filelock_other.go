@@ -0,0 +1,20 @@
+//go:build !unix
+
+package simplejsondb
+
+import "os"
+
+// advisory file locks are only implemented on unix platforms,
+// elsewhere inter-process locking degrades to process-local locking
+
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
+
+func funlock(f *os.File) error {
+	return nil
+}
+
+func tryFlock(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
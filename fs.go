@@ -0,0 +1,94 @@
+package simplejsondb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FS - the file system a database is stored on, selected through Options.FS
+type FS interface {
+	ReadDir(name string) ([]fs.DirEntry, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Mkdir(name string, perm fs.FileMode) error
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// OSFS - the FS of the operating system, used when Options.FS is nil. File locks,
+// inotify, the oplog and the segment engine need it.
+type OSFS struct{}
+
+func (OSFS) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (OSFS) ReadFile(name string) ([]byte, error)       { return os.ReadFile(name) }
+func (OSFS) Rename(oldpath, newpath string) error       { return os.Rename(oldpath, newpath) }
+func (OSFS) Remove(name string) error                   { return os.Remove(name) }
+func (OSFS) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+
+func (OSFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (OSFS) Mkdir(name string, perm fs.FileMode) error { return os.Mkdir(name, perm) }
+
+// AppendFile - appends data to the file, creating it when missing
+func (OSFS) AppendFile(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// isOS - reports whether fsys is the operating system file system
+func isOS(fsys FS) bool {
+	_, ok := fsys.(OSFS)
+	return ok
+}
+
+// fsOf - the file system chosen by options, OSFS by default
+func fsOf(fsys FS) FS {
+	if fsys == nil {
+		return OSFS{}
+	}
+	return fsys
+}
+
+// appendFile - appends data to a file of fsys, rewriting it when fsys cannot append
+func appendFile(fsys FS, name string, data []byte) error {
+	if a, ok := fsys.(interface{ AppendFile(string, []byte) error }); ok {
+		return a.AppendFile(name, data)
+	}
+	old, err := fsys.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return fsys.WriteFile(name, append(old, data...), 0o666)
+}
+
+// mkdirAll - creates a directory of fsys along with any missing parents
+func mkdirAll(fsys FS, path string) error {
+	info, err := fsys.Stat(path)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: path, Err: ErrNoDirectory}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := mkdirAll(fsys, parent); err != nil {
+			return err
+		}
+	}
+	if err := fsys.Mkdir(path, os.ModePerm); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package simplejsondb
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval - how often a polling watcher rescans a collection
+const DefaultPollInterval = 2 * time.Second
+
+// fileSig - what a record file looked like when last seen
+type fileSig struct {
+	size    int64
+	modTime time.Time
+}
+
+// fsWatcher - turns changes made to a collection directory from outside the
+// library into change events
+type fsWatcher struct {
+	c        *collection
+	mode     ExternalWatch
+	interval time.Duration
+	mu       sync.Mutex
+	known    map[string]fileSig // by path relative to the collection
+	stop     chan struct{}
+	done     chan struct{}
+	close    func() error
+}
+
+// startWatcher - watches the collection directory for outside changes
+func (c *collection) startWatcher(mode ExternalWatch, interval time.Duration) error {
+	w := &fsWatcher{
+		c:        c,
+		mode:     mode,
+		interval: interval,
+		known:    make(map[string]fileSig),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := w.scan(false); err != nil {
+		return err
+	}
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	// notifications only cover the collection directory itself, not the shards
+	if mode != WatchPoll && c.layout != LayoutSharded && isOS(c.fs) {
+		err := w.notify()
+		if err == nil {
+			c.watcher.Store(w)
+			return nil
+		}
+		log.Printf("watch %s: falling back to polling: %v", c.path, err)
+	}
+	go w.poll(interval)
+	c.watcher.Store(w)
+	return nil
+}
+
+// stopWatcher - ends the watcher of a collection, if any
+func (c *collection) stopWatcher() error {
+	w := c.watcher.Swap(nil)
+	if w == nil {
+		return nil
+	}
+	close(w.stop)
+	var err error
+	if w.close != nil {
+		err = w.close()
+	}
+	<-w.done
+	return err
+}
+
+func (w *fsWatcher) poll(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.scan(true); err != nil {
+				log.Printf("watch %s: %v", w.c.path, err)
+			}
+		}
+	}
+}
+
+// scan - compares the directory with what was last seen, reporting differences when asked to
+func (w *fsWatcher) scan(report bool) error {
+	seen := make(map[string]bool)
+	var found []string
+	err := w.c.walk(func(dir string, r os.DirEntry) {
+		rel := w.c.relPath(filepath.Join(dir, r.Name()))
+		seen[rel] = true
+		if report {
+			found = append(found, rel)
+		} else if info, err := r.Info(); err == nil {
+			w.known[rel] = fileSig{info.Size(), info.ModTime()}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, rel := range found {
+		w.check(rel)
+	}
+	w.mu.Lock()
+	var gone []string
+	for name := range w.known {
+		if !seen[name] {
+			gone = append(gone, name)
+		}
+	}
+	w.mu.Unlock()
+	for _, name := range gone {
+		w.check(name)
+	}
+	return nil
+}
+
+// check - re-examines one file of the collection and publishes a change event when
+// it differs from what the library itself last wrote or saw
+func (w *fsWatcher) check(name string) {
+	key := recordKey(filepath.Base(name))
+	if key == "" {
+		return
+	}
+	// writes through the library hold the record lock until they have been remembered
+	defer w.c.holdRecord(key, ModeRead)()
+
+	path := filepath.Join(w.c.path, name)
+	info, statErr := w.c.fs.Stat(path)
+	w.mu.Lock()
+	last, known := w.known[name]
+	if statErr != nil {
+		delete(w.known, name)
+	}
+	w.mu.Unlock()
+
+	switch {
+	case statErr != nil && known:
+		w.c.publish(key, OpDelete, nil)
+	case statErr == nil && (!known || last != fileSig{info.Size(), info.ModTime()}):
+		raw, err := w.c.fs.ReadFile(path)
+		if err != nil {
+			return
+		}
+		data := raw
+		if codec, _ := w.c.codecs.byFile(filepath.Base(name)); codec != nil {
+			if data, err = w.c.decode(key, raw, codec); err != nil {
+				// a record edited by hand keeps its old header, reads adopt the edit
+				// until the file is sealed again, after which it is known
+				value, ok := w.c.editedValue(raw, codec)
+				if !errors.Is(err, ErrCorrupt) || !ok {
+					w.see(name, info)
+					log.Printf("watch %s: %s: %v", w.c.path, name, err)
+					return
+				}
+				if w.c.readOnly {
+					w.see(name, info)
+				} else if !w.c.reseal(key, path, raw, value) {
+					return // sealed by a read meanwhile, which published it
+				}
+				data = value
+			} else {
+				w.see(name, info)
+			}
+		} else {
+			w.see(name, info)
+		}
+		w.c.publish(key, OpCreate, data)
+	}
+}
+
+// see - records what a file looked like when it was handled
+func (w *fsWatcher) see(name string, info os.FileInfo) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.known[name] = fileSig{info.Size(), info.ModTime()}
+}
+
+// changedOutside - reports whether the watcher of the collection tells the file
+// filename changed since the library last wrote or saw it
+func (c *collection) changedOutside(filename string) bool {
+	w := c.watcher.Load()
+	if w == nil {
+		return false
+	}
+	info, err := c.fs.Stat(filename)
+	if err != nil {
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	last, known := w.known[c.relPath(filename)]
+	return !known || last != fileSig{info.Size(), info.ModTime()}
+}
+
+// remember - records a file written by the library itself so the watcher ignores it
+func (c *collection) remember(filename string) {
+	c.markDirty(filename)
+	w := c.watcher.Load()
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	name := c.relPath(filename)
+	if info, err := c.fs.Stat(filename); err == nil {
+		w.known[name] = fileSig{info.Size(), info.ModTime()}
+	} else {
+		delete(w.known, name)
+	}
+}
+
+// relPath - path of a file relative to the collection directory
+func (c *collection) relPath(filename string) string {
+	if rel, err := filepath.Rel(c.path, filename); err == nil {
+		return rel
+	}
+	return filename
+}
+
+// recordKey - the key stored in a record file name, empty for other files
+func recordKey(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return ""
+	}
+	for _, ext := range recordExts() {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return ""
+}
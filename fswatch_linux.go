@@ -0,0 +1,58 @@
+//go:build linux
+
+package simplejsondb
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// notify - watches the collection directory with inotify
+func (w *fsWatcher) notify() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE)
+	if _, err := syscall.InotifyAddWatch(fd, w.c.path, mask); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	// a non-blocking descriptor goes through the runtime poller, so Close interrupts Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	w.close = f.Close
+	go w.read(f)
+	return nil
+}
+
+func (w *fsWatcher) read(f *os.File) {
+	defer close(w.done)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.stop:
+			default:
+				log.Printf("watch %s: %v", w.c.path, err)
+			}
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			e := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[start:start+int(e.Len)], "\x00"))
+			off = start + int(e.Len)
+			if e.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.scan(true) // events were lost, compare everything
+				continue
+			}
+			if name != "" {
+				w.check(name)
+			}
+		}
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package simplejsondb
+
+import "errors"
+
+// notify - no native directory notifications on this platform, the watcher polls
+func (w *fsWatcher) notify() error {
+	return errors.New("directory notifications not supported")
+}
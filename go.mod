@@ -2,4 +2,7 @@ module github.com/pnkj-kmr/simple-json-db
 
 go 1.22.3
 
-require golang.org/x/exp v0.0.0-20241004190924-225e2abe05e6
+require (
+	github.com/klauspost/compress v1.17.11
+	golang.org/x/exp v0.0.0-20241004190924-225e2abe05e6
+)
@@ -13,6 +13,9 @@ func UnGzip(record []byte) (result []byte, err error) {
 		return record, err
 	}
 	reader, err := gzip.NewReader(&buffer)
+	if err != nil {
+		return record, err
+	}
 
 	result, err = io.ReadAll(reader)
 	if err != nil {
@@ -0,0 +1,125 @@
+package simplejsondb
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// BeforeHook - runs before a record is written or deleted, under its record lock. It
+// returns the data to write (ignored on delete) or an error vetoing the operation.
+// It must not touch its own key at all: even a Get of it waits for that lock forever.
+type BeforeHook func(collection, key string, data []byte) ([]byte, error)
+
+// AfterHook - runs once a record has been written or deleted, before its record lock
+// is released; like a BeforeHook it must not touch its own key
+type AfterHook func(collection, key string, data []byte)
+
+// hooks - registered callbacks of a database or collection
+type hooks struct {
+	mu           sync.RWMutex
+	beforeCreate []BeforeHook
+	afterCreate  []AfterHook
+	beforeDelete []BeforeHook
+	afterDelete  []AfterHook
+}
+
+// BeforeCreate registers a hook run before every Create of the collection
+func (c *collection) BeforeCreate(fn BeforeHook) {
+	addHook(&c.hooks, &c.hooks.beforeCreate, fn)
+}
+
+// AfterCreate registers a hook run after every Create of the collection
+func (c *collection) AfterCreate(fn AfterHook) {
+	addHook(&c.hooks, &c.hooks.afterCreate, fn)
+}
+
+// BeforeDelete registers a hook run before every Delete of the collection
+func (c *collection) BeforeDelete(fn BeforeHook) {
+	addHook(&c.hooks, &c.hooks.beforeDelete, fn)
+}
+
+// AfterDelete registers a hook run after every Delete of the collection
+func (c *collection) AfterDelete(fn AfterHook) {
+	addHook(&c.hooks, &c.hooks.afterDelete, fn)
+}
+
+// BeforeCreate registers a hook run before every Create of any collection
+func (db *db) BeforeCreate(fn BeforeHook) {
+	addHook(&db.hooks, &db.hooks.beforeCreate, fn)
+}
+
+// AfterCreate registers a hook run after every Create of any collection
+func (db *db) AfterCreate(fn AfterHook) {
+	addHook(&db.hooks, &db.hooks.afterCreate, fn)
+}
+
+// BeforeDelete registers a hook run before every Delete of any collection
+func (db *db) BeforeDelete(fn BeforeHook) {
+	addHook(&db.hooks, &db.hooks.beforeDelete, fn)
+}
+
+// AfterDelete registers a hook run after every Delete of any collection
+func (db *db) AfterDelete(fn AfterHook) {
+	addHook(&db.hooks, &db.hooks.afterDelete, fn)
+}
+
+func addHook[T BeforeHook | AfterHook](h *hooks, list *[]T, fn T) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*list = append(*list, fn)
+}
+
+// before - runs the database wide, then the collection before hooks in registration order
+func (c *collection) before(pick func(*hooks) []BeforeHook, key string, data []byte) ([]byte, error) {
+	for _, h := range []*hooks{c.dbHooks, &c.hooks} {
+		if h == nil {
+			continue
+		}
+		h.mu.RLock()
+		fns := pick(h)
+		h.mu.RUnlock()
+		for _, fn := range fns {
+			var err error
+			if data, err = c.runBefore(fn, key, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return data, nil
+}
+
+// after - runs the database wide, then the collection after hooks in registration order
+func (c *collection) after(pick func(*hooks) []AfterHook, key string, data []byte) {
+	for _, h := range []*hooks{c.dbHooks, &c.hooks} {
+		if h == nil {
+			continue
+		}
+		h.mu.RLock()
+		fns := pick(h)
+		h.mu.RUnlock()
+		for _, fn := range fns {
+			c.runAfter(fn, key, data)
+		}
+	}
+}
+
+// helper: a panicking before hook vetoes the operation with ErrHookPanic
+func (c *collection) runBefore(fn BeforeHook, key string, data []byte) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrHookPanic, r)
+		}
+	}()
+	return fn(c.name, key, data)
+}
+
+// helper: a panicking after hook is logged, the operation is already done
+func (c *collection) runAfter(fn AfterHook, key string, data []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("after hook on %s/%s: %v: %v", c.name, key, ErrHookPanic, r)
+		}
+	}()
+	fn(c.name, key, data)
+}
@@ -0,0 +1,169 @@
+package simplejsondb
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Directory layouts of the record files of a collection
+const (
+	// LayoutFlat keeps every record file directly in the collection directory.
+	LayoutFlat = "flat"
+	// LayoutSharded spreads record files over two levels of subdirectories
+	// named after the key hash, e.g. ab/cd/key.json.
+	LayoutSharded = "sharded"
+)
+
+// recordDir - directory holding the record files of key in the given layout
+func (c *collection) recordDir(key, layout string) string {
+	if layout == LayoutSharded {
+		sum := sha1.Sum([]byte(key))
+		h := hex.EncodeToString(sum[:2])
+		return filepath.Join(c.path, h[:2], h[2:])
+	}
+	return c.path
+}
+
+// recordDirs - where the files of key may be, the current layout first; during a
+// layout migration a record may still sit where the other layout puts it
+func (c *collection) recordDirs(key string) []string {
+	other := LayoutSharded
+	if c.layout == LayoutSharded {
+		other = LayoutFlat
+	}
+	return []string{c.recordDir(key, c.layout), c.recordDir(key, other)}
+}
+
+// walk - calls fn for every record file of the collection, in either layout
+func (c *collection) walk(fn func(dir string, r os.DirEntry)) error {
+	return walkDir(c.fs, c.path, 0, fn)
+}
+
+func walkDir(fsys FS, dir string, depth int, fn func(dir string, r os.DirEntry)) error {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, r := range entries {
+		if isRecord(r) {
+			fn(dir, r)
+		} else if depth < 2 && isShardDir(r) {
+			if err := walkDir(fsys, filepath.Join(dir, r.Name()), depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isShardDir - reports whether a directory entry is a level of the sharded layout
+func isShardDir(r os.DirEntry) bool {
+	name := r.Name()
+	if !r.IsDir() || len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// MigrateLayout moves the record files of the collection into layout while it stays
+// online: new writes use the new layout right away and records not moved yet are
+// still found. An interrupted migration is completed by running it again.
+func (c *collection) MigrateLayout(layout string) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if layout != LayoutFlat && layout != LayoutSharded {
+		return ErrUnknownLayout
+	}
+	if c.store != nil {
+		return ErrNotSupported
+	}
+
+	c.mu.Lock()
+	if c.dropped.Load() {
+		c.mu.Unlock()
+		return ErrDropped
+	}
+	meta := *c.meta
+	meta.Layout, meta.Migrated = layout, true
+	if err := writeMeta(c.fs, c.path, &meta); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.meta, c.layout = &meta, layout
+	c.mu.Unlock()
+
+	type file struct{ dir, name string }
+	var files []file
+	err := c.walk(func(dir string, r os.DirEntry) {
+		files = append(files, file{dir, r.Name()})
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		key := recordKey(f.name)
+		if key == "" || f.dir == c.recordDir(key, layout) {
+			continue
+		}
+		if err := c.moveRecord(key, f.dir, f.name); err != nil {
+			return err
+		}
+	}
+	if layout == LayoutFlat {
+		removeEmptyShards(c.fs, c.path, 0)
+	}
+	// a directory watcher follows the new layout
+	if w := c.watcher.Load(); w != nil {
+		if err := c.stopWatcher(); err != nil {
+			return err
+		}
+		return c.startWatcher(w.mode, w.interval)
+	}
+	return nil
+}
+
+// helper: moves one record file into the current layout under the record lock
+func (c *collection) moveRecord(key, dir, name string) error {
+	release, err := c.lockRecord(key, ModeWrite, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	from := filepath.Join(dir, name)
+	if _, err := c.fs.Stat(from); errors.Is(err, fs.ErrNotExist) {
+		return nil // rewritten or deleted meanwhile
+	}
+	target := c.recordDir(key, c.layout)
+	if err := mkdirAll(c.fs, target); err != nil {
+		return err
+	}
+	to := filepath.Join(target, name)
+	if err := c.fs.Rename(from, to); err != nil {
+		return err
+	}
+	c.remember(from)
+	c.remember(to)
+	return nil
+}
+
+// removeEmptyShards - drops the subdirectories a sharded layout leaves behind
+func removeEmptyShards(fsys FS, dir string, depth int) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, r := range entries {
+		if depth < 2 && isShardDir(r) {
+			sub := filepath.Join(dir, r.Name())
+			removeEmptyShards(fsys, sub, depth+1)
+			fsys.Remove(sub) // fails, as intended, when not empty
+		}
+	}
+}
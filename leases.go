@@ -0,0 +1,98 @@
+package simplejsondb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"time"
+)
+
+// lease - a granted Lease along with its expiry timer
+type lease struct {
+	Lease
+	timer *time.Timer
+	file  bool // holds a share of the inter-process lock of the record
+}
+
+// helper: registers a lease for a freshly acquired lock; recMu must be held
+func (c *collection) grant(id, token string, mode LockMode, opts LockOptions) *Lease {
+	if c.recLeases == nil {
+		c.recLeases = make(map[string]*lease)
+	}
+	ttl := opts.TTL
+	if ttl < 0 {
+		ttl = 0
+	}
+	ls := &lease{Lease: Lease{
+		ID:       id,
+		Token:    token,
+		Mode:     mode,
+		Scope:    opts.Scope,
+		Owner:    opts.Owner,
+		TTL:      ttl,
+		Acquired: time.Now(),
+	}}
+	if ttl > 0 {
+		ls.Expires = time.Now().Add(ttl)
+		token := ls.Token
+		ls.timer = time.AfterFunc(ttl, func() { c.expire(token) })
+	}
+	c.recLeases[ls.Token] = ls
+	copied := ls.Lease
+	return &copied
+}
+
+// RenewID extends the lease held under token on a specific record ID by ttl,
+// or by the lease's own TTL when ttl is zero.
+func (c *collection) RenewID(id string, token string, ttl time.Duration) (*Lease, error) {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	ls := c.recLeases[token]
+	if ls == nil || ls.ID != id {
+		return nil, ErrNotOwner
+	}
+	if ttl == 0 {
+		ttl = ls.TTL
+	}
+	ls.TTL = ttl
+	if ttl > 0 {
+		ls.Expires = time.Now().Add(ttl)
+		if ls.timer == nil {
+			ls.timer = time.AfterFunc(ttl, func() { c.expire(token) })
+		} else {
+			ls.timer.Reset(ttl)
+		}
+	} else {
+		ls.Expires = time.Time{}
+		if ls.timer != nil {
+			ls.timer.Stop()
+		}
+	}
+	copied := ls.Lease
+	return &copied, nil
+}
+
+// helper: reclaims the lock held by an expired lease
+func (c *collection) expire(token string) {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	ls := c.recLeases[token]
+	if ls == nil || ls.Expires.IsZero() || time.Now().Before(ls.Expires) {
+		return // released or renewed meanwhile
+	}
+	c.stats.expired.Add(1)
+	log.Printf("lease expired: reclaiming lock on ID '%s' with mode %d held since %s",
+		ls.ID, ls.Mode, ls.Acquired.Format(time.RFC3339))
+	if err := c.release(ls); err != nil {
+		log.Printf("lease expired: releasing ID '%s': %v", ls.ID, err)
+	}
+}
+
+// newToken - a random owner token; a predictable one would let others release the lock
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,25 +1,32 @@
 package simplejsondb
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"sort"
 	"sync"
+	"time"
 )
 
-// helper: returns the RWMutex for a specific record ID, creating it if needed
+// helper: returns the RWMutex for a specific record ID, creating it if needed,
+// and registers the caller as a waiter on it
 func (c *collection) newLock(id string) *sync.RWMutex {
 	c.recMu.Lock()
 	defer c.recMu.Unlock()
 	if c.recLocks == nil {
 		c.recLocks = make(map[string]*sync.RWMutex)
 	}
+	if c.recWaiters == nil {
+		c.recWaiters = make(map[string]int)
+	}
 	l, ok := c.recLocks[id]
 	if !ok || l == nil {
 		l = &sync.RWMutex{}
 		c.recLocks[id] = l
 	}
+	c.recWaiters[id]++
 	return l
 }
 
@@ -38,26 +45,6 @@ func (c *collection) newWg(id string) *sync.WaitGroup {
 	return wg
 }
 
-// helper: returns the RWMutex for a specific record ID if it exists; does not create it
-func (c *collection) getLockIfExists(id string) *sync.RWMutex {
-	c.recMu.Lock()
-	defer c.recMu.Unlock()
-	if c.recLocks == nil {
-		return nil
-	}
-	return c.recLocks[id]
-}
-
-// helper: returns the WaitGroup for a specific record ID if it exists; does not create it
-func (c *collection) getWGIfExists(id string) *sync.WaitGroup {
-	c.recMu.Lock()
-	defer c.recMu.Unlock()
-	if c.recWg == nil {
-		return nil
-	}
-	return c.recWg[id]
-}
-
 // helper: returns the LockState for a specific ID, creating it if needed
 func (c *collection) doState(id string) *LockState {
 	c.recMu.Lock()
@@ -73,51 +60,174 @@ func (c *collection) doState(id string) *LockState {
 	return st
 }
 
-// helper: returns the LockState for a specific ID if it exists; does not create it
-func (c *collection) getStateIfExists(id string) *LockState {
-	c.recMu.Lock()
-	defer c.recMu.Unlock()
-	if c.recStates == nil {
-		return nil
+// LockID allows manual locking for a specific record ID.
+// The returned Lease carries the owner token needed by UnlockID and RenewID;
+// given a TTL, the lock is reclaimed once it has passed unless renewed.
+// With ScopeInterProcess the record is also locked against other processes
+// until it is fully unlocked in this one. A Timeout in options bounds the wait.
+func (c *collection) LockID(id string, mode LockMode, options ...LockOptions) (*Lease, error) {
+	return c.lockID(context.Background(), id, mode, options)
+}
+
+// TryLockID acquires the lock for a specific record ID only if it is available right away,
+// otherwise it returns ErrLockBusy without waiting.
+func (c *collection) TryLockID(id string, mode LockMode, options ...LockOptions) (*Lease, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ls, err := c.lockID(ctx, id, mode, options)
+	if errors.Is(err, context.Canceled) {
+		err = ErrLockBusy
 	}
-	return c.recStates[id]
+	return ls, err
 }
 
-// LockID allows manual locking for a specific record ID.
-func (c *collection) LockID(id string, mode LockMode) (LockMode, error) {
+// LockIDContext acquires the lock for a specific record ID, giving up with the
+// context error (context.DeadlineExceeded on timeout) once ctx is done.
+func (c *collection) LockIDContext(ctx context.Context, id string, mode LockMode, options ...LockOptions) (*Lease, error) {
+	return c.lockID(ctx, id, mode, options)
+}
+
+func (c *collection) lockID(ctx context.Context, id string, mode LockMode, options []LockOptions) (*Lease, error) {
 	if mode == NoMode {
-		return NoMode, nil
+		return nil, nil
+	}
+	opts := LockOptions{}
+	if options != nil {
+		opts = options[0]
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
 	}
 
-	var err error = nil
-	// detect possible deadlock due to double locking
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("deadlock detected: possible double lock on ID '" + id + "' with mode " + strconv.Itoa(int(mode)))
-			err = errors.New(fmt.Sprintf("%v", r))
-		}
-	}()
+	if opts.Owner == "" {
+		opts.Owner = c.anonymousOwner()
+	}
+	token, err := newToken()
+	if err != nil {
+		return nil, err
+	}
+
+	// registering as a waiter keeps the lock from being cleaned up under us
 	l := c.newLock(id)
+	start := time.Now()
+	waited, err := c.acquire(ctx, l, id, mode, opts.Owner)
+	c.stats.record(waited, time.Since(start), err)
+	if err != nil {
+		c.recMu.Lock()
+		c.recWaiters[id]--
+		c.cleanup(id)
+		c.recMu.Unlock()
+		return nil, err
+	}
 	wg := c.newWg(id)
 	st := c.doState(id)
 
+	c.recMu.Lock()
+	c.recWaiters[id]--
 	switch mode {
 	case ModeRead:
-		l.RLock()
 		st.R++
-		wg.Add(1)
 	case ModeReadWrite:
-		l.Lock()
 		st.W++
 		st.R++
-		wg.Add(1)
 	default: // ModeWrite and any other treated as exclusive
-		l.Lock()
 		st.W++
-		wg.Add(1)
 	}
+	wg.Add(1)
 	// update recorded mode to reflect the current state safely
+	c.updateMode(id, st)
+	lease := c.grant(id, token, mode, opts)
+	c.recMu.Unlock()
+
+	if opts.Scope == ScopeInterProcess {
+		if err := c.lockRecordFile(ctx, id, mode); err != nil {
+			c.UnlockID(id, lease.Token)
+			return nil, err
+		}
+		c.recMu.Lock()
+		if ls := c.recLeases[lease.Token]; ls != nil {
+			ls.file = true
+		} else {
+			c.unlockRecordFile(id) // expired meanwhile
+		}
+		c.recMu.Unlock()
+	}
+
+	return lease, nil
+}
+
+// acquire - takes the lock l of id in the given mode, waiting until ctx is done.
+// While waiting, owner is part of the wait-for graph, and a wait which would deadlock
+// fails with ErrDeadlock whether it is bounded by ctx or not. An acquisition abandoned
+// when ctx is done is released in the background once it completes.
+// It reports whether the lock was contended.
+func (c *collection) acquire(ctx context.Context, l *sync.RWMutex, id string, mode LockMode, owner string) (bool, error) {
+	if tryLock(l, mode) {
+		return false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return true, err
+	}
 	c.recMu.Lock()
+	w, err := c.wait(owner, id, mode)
+	c.recMu.Unlock()
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		c.recMu.Lock()
+		c.unwait(w)
+		c.recMu.Unlock()
+	}()
+	if ctx.Done() == nil {
+		lock(l, mode)
+		return true, nil
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		lock(l, mode)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return true, nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			unlock(l, mode)
+		}()
+		return true, ctx.Err()
+	}
+}
+
+func tryLock(l *sync.RWMutex, mode LockMode) bool {
+	if mode == ModeRead {
+		return l.TryRLock()
+	}
+	return l.TryLock()
+}
+
+func lock(l *sync.RWMutex, mode LockMode) {
+	if mode == ModeRead {
+		l.RLock()
+	} else {
+		l.Lock()
+	}
+}
+
+func unlock(l *sync.RWMutex, mode LockMode) {
+	if mode == ModeRead {
+		l.RUnlock()
+	} else {
+		l.Unlock()
+	}
+}
+
+// helper: records the aggregate mode of an ID from its LockState; recMu must be held
+func (c *collection) updateMode(id string, st *LockState) {
 	if c.recModes == nil {
 		c.recModes = make(map[string]LockMode)
 	}
@@ -132,122 +242,186 @@ func (c *collection) LockID(id string, mode LockMode) (LockMode, error) {
 	} else {
 		c.recModes[id] = NoMode
 	}
-	c.recMu.Unlock()
+}
+
+// helper: drops the holders of an ID once nobody holds, waits for or operates on it; recMu must be held
+func (c *collection) cleanup(id string) {
+	if st := c.recStates[id]; st != nil && (st.R > 0 || st.W > 0) {
+		return
+	}
+	if c.recWaiters[id] > 0 || c.recOps[id] > 0 {
+		return
+	}
+	delete(c.recModes, id)
+	delete(c.recLocks, id)
+	delete(c.recStates, id)
+	delete(c.recWg, id)
+	delete(c.recWaiters, id)
+	delete(c.recOps, id)
+}
+
+// lockRecord - takes the record lock an operation on key needs, unless options
+// carry a lease already covering it, then shares the collection with other record
+// operations. Collection wide operations hold mu exclusively.
+func (c *collection) lockRecord(key string, mode LockMode, options []Options) (release func(), err error) {
+	if options != nil && options[0].Lease != nil {
+		if err := c.checkLease(key, mode, options[0].Lease); err != nil {
+			return nil, err
+		}
+		c.mu.RLock()
+		if c.dropped.Load() {
+			c.mu.RUnlock()
+			return nil, ErrDropped
+		}
+		return c.mu.RUnlock, nil
+	}
 
-	return mode, err
+	unlock := c.holdRecord(key, mode)
+	c.mu.RLock()
+	if c.dropped.Load() {
+		c.mu.RUnlock()
+		unlock()
+		return nil, ErrDropped
+	}
+	return func() {
+		c.mu.RUnlock()
+		unlock()
+	}, nil
 }
 
-// UnlockID releases a previously acquired lock for a specific record ID.
-// mode should match the mode used in LockID.
-func (c *collection) UnlockID(id string) error {
-	// read current mode under lock for consistency
+// holdRecord - takes the lock of a record for an operation of the library itself.
+// Leases hold the same RWMutex, so such operations wait for them and the other way
+// round, but no lease is granted: the lock is only registered as in use meanwhile.
+func (c *collection) holdRecord(id string, mode LockMode) (release func()) {
 	c.recMu.Lock()
-	mode := c.recModes[id]
+	if c.recLocks == nil {
+		c.recLocks = make(map[string]*sync.RWMutex)
+	}
+	if c.recOps == nil {
+		c.recOps = make(map[string]int)
+	}
+	l := c.recLocks[id]
+	if l == nil {
+		l = &sync.RWMutex{}
+		c.recLocks[id] = l
+	}
+	c.recOps[id]++
 	c.recMu.Unlock()
-	if mode == NoMode {
-		return nil
+
+	if tryLock(l, mode) {
+		c.stats.record(false, 0, nil)
+	} else {
+		start := time.Now()
+		lock(l, mode)
+		c.stats.record(true, time.Since(start), nil)
 	}
-	var err error = nil
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("deadlock detected: possible double unlock on ID '" + id + "' with mode " + strconv.Itoa(int(mode)))
-			err = errors.New(fmt.Sprintf("%v", r))
-		}
-	}()
-	// Do not create a new lock when unlocking; if lock/state don't exist, it's a no-op
-	l := c.getLockIfExists(id)
-	st := c.getStateIfExists(id)
-	if l == nil || st == nil {
+	return func() {
+		unlock(l, mode)
+		c.recMu.Lock()
+		c.recOps[id]--
+		c.cleanup(id)
+		c.recMu.Unlock()
+	}
+}
+
+// leaseOf - the lease options of a record operation carry, nil without one
+func leaseOf(options []Options) *Lease {
+	if len(options) == 0 {
 		return nil
 	}
+	return options[0].Lease
+}
 
-	switch mode {
+// helper: verifies lease is currently held on key in a mode allowing the operation
+func (c *collection) checkLease(key string, mode LockMode, lease *Lease) error {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	ls := c.recLeases[lease.Token]
+	if ls == nil || ls.ID != key {
+		return ErrNotOwner
+	}
+	if mode != ModeRead && ls.Mode == ModeRead {
+		return ErrLeaseMode
+	}
+	return nil
+}
+
+// UnlockID releases the lock on a specific record ID held under the given lease token.
+func (c *collection) UnlockID(id string, token string) error {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	ls := c.recLeases[token]
+	if ls == nil || ls.ID != id {
+		return ErrNotOwner
+	}
+	return c.release(ls)
+}
+
+// helper: releases a lease and its share of the record lock; recMu must be held
+func (c *collection) release(ls *lease) (err error) {
+	id := ls.ID
+	if ls.timer != nil {
+		ls.timer.Stop()
+	}
+	delete(c.recLeases, ls.Token)
+
+	st := c.recStates[id]
+	switch ls.Mode {
 	case ModeRead:
-		if st.R <= 0 {
-			err = errors.New("double unlock: read lock not held")
-		} else {
-			st.R--
-			l.RUnlock()
-		}
+		st.R--
 	case ModeReadWrite:
-		if st.R <= 0 || st.W <= 0 {
-			err = errors.New("double unlock: read/write lock not held")
-		} else {
-			st.R--
-			st.W--
-			l.Unlock()
-		}
+		st.R--
+		st.W--
 	default: // write/read_write/other (exclusive)
-		if st.W <= 0 {
-			err = errors.New("double unlock: write lock not held")
-		} else {
-			st.W--
-			l.Unlock()
-		}
+		st.W--
 	}
+	if ls.file {
+		err = c.unlockRecordFile(id)
+	}
+	unlock(c.recLocks[id], ls.Mode)
 
-	if err == nil {
-		// decrement waitgroup once per successful unlock
-		if wg := c.getWGIfExists(id); wg != nil {
-			defer func() {
-				if r := recover(); r != nil {
-					log.Printf("WaitGroup panic on UnlockID for ID '" + id + "': " + fmt.Sprintf("%v", r))
-				}
-			}()
-			wg.Done()
-		}
-		// recompute and possibly cleanup maps only when fully unlocked
-		c.recMu.Lock()
-		if st.W > 0 {
-			if st.R > 0 {
-				c.recModes[id] = ModeReadWrite
-			} else {
-				c.recModes[id] = ModeWrite
-			}
-		} else if st.R > 0 {
-			c.recModes[id] = ModeRead
-		} else {
-			c.recModes[id] = NoMode
-			// fully unlocked: cleanup holders
-			if c.recLocks != nil {
-				delete(c.recLocks, id)
+	// decrement waitgroup once per successful unlock
+	if wg := c.recWg[id]; wg != nil {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("WaitGroup panic on UnlockID for ID '" + id + "': " + fmt.Sprintf("%v", r))
 			}
-			if c.recStates != nil {
-				delete(c.recStates, id)
-			}
-			if c.recWg != nil {
-				delete(c.recWg, id)
-			}
-		}
-		c.recMu.Unlock()
+		}()
+		wg.Done()
 	}
-
+	// recompute and possibly cleanup maps only when fully unlocked
+	c.updateMode(id, st)
+	c.cleanup(id)
 	return err
 }
 
-// GetLock returns the RecordLock (RWMutex + LockState) for a specific record ID.
+// GetLock returns the RecordLock (RWMutex + a snapshot of its LockState) for a specific record ID.
 func (c *collection) GetLock(id string) *RecordLock {
-	lock := c.getLockIfExists(id)
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	lock := c.recLocks[id]
 	if lock == nil {
 		return nil
 	}
-	exists := c.getStateIfExists(id)
-	mode := c.recModes[id]
-	if exists == nil {
-		exists = &LockState{}
+	state := LockState{}
+	if st := c.recStates[id]; st != nil {
+		state = *st
 	}
+	mode := c.recModes[id]
 	return &RecordLock{
 		ID:    id,
 		Lock:  lock,
-		State: exists,
+		State: &state,
 		Mode:  &mode,
-		WG:    c.getWGIfExists(id),
+		WG:    c.recWg[id],
 	}
 }
 
 func (c *collection) IsLock(id string) bool {
-	l := c.getLockIfExists(id)
-	st := c.getStateIfExists(id)
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	l := c.recLocks[id]
+	st := c.recStates[id]
 	mode := c.recModes[id]
 	if l == nil || st == nil {
 		return false
@@ -275,3 +449,63 @@ func (c *collection) WaitUnlock(id string) *RecordLock {
 
 	return lock
 }
+
+// LockIDs locks several record IDs at once. They are acquired in sorted order,
+// so concurrent callers can never deadlock on each other, and any lock already
+// taken is released again when one of them fails or the Timeout passes. Without
+// an Owner in options the locks of the set share one owner of their own.
+func (c *collection) LockIDs(ids []string, mode LockMode, options ...LockOptions) (*MultiLease, error) {
+	opts := LockOptions{}
+	if options != nil {
+		opts = options[0]
+	}
+	ctx := context.Background()
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+		opts.Timeout = 0
+	}
+	if opts.Owner == "" {
+		opts.Owner = c.anonymousOwner()
+	}
+
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	m := &MultiLease{c: c}
+	for i, id := range sorted {
+		if i > 0 && id == sorted[i-1] {
+			continue
+		}
+		lease, err := c.lockID(ctx, id, mode, []LockOptions{opts})
+		if err != nil {
+			m.Unlock()
+			return nil, err
+		}
+		if lease != nil {
+			m.Leases = append(m.Leases, lease)
+		}
+	}
+	return m, nil
+}
+
+// Lease returns the lease held on id, nil if id is not part of the set
+func (m *MultiLease) Lease(id string) *Lease {
+	for _, lease := range m.Leases {
+		if lease.ID == id {
+			return lease
+		}
+	}
+	return nil
+}
+
+// Unlock releases every lease of the set in reverse order, returning the first error
+func (m *MultiLease) Unlock() (err error) {
+	for i := len(m.Leases) - 1; i >= 0; i-- {
+		if uerr := m.c.UnlockID(m.Leases[i].ID, m.Leases[i].Token); uerr != nil && err == nil {
+			err = uerr
+		}
+	}
+	m.Leases = nil
+	return err
+}
@@ -0,0 +1,140 @@
+package simplejsondb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// LockInfo - a record lock currently held, as listed by Locks
+type LockInfo struct {
+	ID      string
+	Mode    LockMode
+	Readers int
+	Owners  []string
+	Held    time.Duration // since the oldest lease on the record was granted
+	Waiters int
+}
+
+// LockStats - lock counters of a collection since it was opened
+type LockStats struct {
+	Acquisitions uint64        // locks granted
+	Contended    uint64        // acquisitions which had to wait
+	WaitTime     time.Duration // total time spent waiting for contended locks
+	Timeouts     uint64        // acquisitions abandoned because the context was done
+	Deadlocks    uint64        // acquisitions refused with ErrDeadlock
+	Expired      uint64        // leases reclaimed after their TTL
+}
+
+// lockCounters - atomically updated backing of LockStats
+type lockCounters struct {
+	acquisitions atomic.Uint64
+	contended    atomic.Uint64
+	waitTime     atomic.Int64
+	timeouts     atomic.Uint64
+	deadlocks    atomic.Uint64
+	expired      atomic.Uint64
+}
+
+func (s *lockCounters) record(waited bool, wait time.Duration, err error) {
+	switch {
+	case err == nil:
+		s.acquisitions.Add(1)
+	case errors.Is(err, ErrDeadlock):
+		s.deadlocks.Add(1)
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		s.timeouts.Add(1)
+	}
+	if waited {
+		s.contended.Add(1)
+		s.waitTime.Add(int64(wait))
+	}
+}
+
+// Locks lists every record lock currently held in the collection, sorted by ID
+func (c *collection) Locks() (locks []LockInfo) {
+	c.recMu.Lock()
+	defer c.recMu.Unlock()
+	now := time.Now()
+	byID := map[string]*LockInfo{}
+	for _, ls := range c.recLeases {
+		info, ok := byID[ls.ID]
+		if !ok {
+			info = &LockInfo{ID: ls.ID, Mode: c.recModes[ls.ID], Waiters: c.recWaiters[ls.ID]}
+			if st := c.recStates[ls.ID]; st != nil {
+				info.Readers = st.R
+			}
+			byID[ls.ID] = info
+		}
+		info.Owners = append(info.Owners, ls.Owner)
+		if held := now.Sub(ls.Acquired); held > info.Held {
+			info.Held = held
+		}
+	}
+	for _, info := range byID {
+		sort.Strings(info.Owners)
+		locks = append(locks, *info)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	return
+}
+
+// LockStats returns the lock counters of the collection
+func (c *collection) LockStats() LockStats {
+	return LockStats{
+		Acquisitions: c.stats.acquisitions.Load(),
+		Contended:    c.stats.contended.Load(),
+		WaitTime:     time.Duration(c.stats.waitTime.Load()),
+		Timeouts:     c.stats.timeouts.Load(),
+		Deadlocks:    c.stats.deadlocks.Load(),
+		Expired:      c.stats.expired.Load(),
+	}
+}
+
+// WriteMetrics writes the lock counters and held locks of every opened collection
+// in the Prometheus text exposition format, ready to be served to a scraper
+func (db *db) WriteMetrics(w io.Writer) error {
+	// the handles are taken once, a LoadFrom meanwhile only drops them from the map
+	db.mu.Lock()
+	cols := make([]*collection, 0, len(db.collections))
+	for _, c := range db.collections {
+		cols = append(cols, c)
+	}
+	db.mu.Unlock()
+	sort.Slice(cols, func(i, j int) bool { return cols[i].name < cols[j].name })
+
+	metrics := []struct {
+		name, help, kind string
+		value            func(s LockStats, c *collection) float64
+	}{
+		{"simplejsondb_lock_acquisitions_total", "Record locks granted.", "counter",
+			func(s LockStats, _ *collection) float64 { return float64(s.Acquisitions) }},
+		{"simplejsondb_lock_contended_total", "Record lock acquisitions which had to wait.", "counter",
+			func(s LockStats, _ *collection) float64 { return float64(s.Contended) }},
+		{"simplejsondb_lock_wait_seconds_total", "Time spent waiting for contended record locks.", "counter",
+			func(s LockStats, _ *collection) float64 { return s.WaitTime.Seconds() }},
+		{"simplejsondb_lock_timeouts_total", "Record lock acquisitions abandoned on context or timeout.", "counter",
+			func(s LockStats, _ *collection) float64 { return float64(s.Timeouts) }},
+		{"simplejsondb_lock_deadlocks_total", "Record lock acquisitions refused as deadlocks.", "counter",
+			func(s LockStats, _ *collection) float64 { return float64(s.Deadlocks) }},
+		{"simplejsondb_lock_expired_total", "Record lock leases reclaimed after their TTL.", "counter",
+			func(s LockStats, _ *collection) float64 { return float64(s.Expired) }},
+		{"simplejsondb_locks_held", "Record locks currently held.", "gauge",
+			func(_ LockStats, c *collection) float64 { return float64(len(c.Locks())) }},
+	}
+	for _, m := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, c := range cols {
+			if _, err := fmt.Fprintf(w, "%s{collection=%q} %g\n", m.name, c.name, m.value(c.LockStats(), c)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
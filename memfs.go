@@ -0,0 +1,227 @@
+package simplejsondb
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS - an FS keeping every file in memory, safe for concurrent use
+type MemFS struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	name     string
+	data     []byte
+	mode     fs.FileMode
+	modTime  time.Time
+	children map[string]*memNode // nil for files
+}
+
+// NewMemFS - an empty in-memory file system; relative and absolute paths share one tree
+func NewMemFS() *MemFS {
+	root := &memNode{name: ".", mode: fs.ModeDir | 0o777, modTime: time.Now(), children: make(map[string]*memNode)}
+	return &MemFS{nodes: map[string]*memNode{".": root}}
+}
+
+// memPath - the key of a path in the tree
+func memPath(name string) string {
+	name = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+func memParent(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return "."
+}
+
+// helper: the directory meant to hold name; mu must be held
+func (m *MemFS) parent(op, name string) (*memNode, error) {
+	dir, ok := m.nodes[memParent(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if dir.children == nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: ErrNoDirectory}
+	}
+	return dir, nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.nodes[memPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.children == nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: ErrNoDirectory}
+	}
+	entries := make([]fs.DirEntry, 0, len(n.children))
+	for _, c := range n.children {
+		entries = append(entries, fs.FileInfoToDirEntry(c.info()))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.nodes[memPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.children != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *MemFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write(name, append([]byte(nil), data...), perm)
+}
+
+// AppendFile - appends data to the file, creating it when missing
+func (m *MemFS) AppendFile(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := m.nodes[memPath(name)]; ok && n.children == nil {
+		n.data = append(n.data, data...)
+		n.modTime = time.Now()
+		return nil
+	}
+	return m.write(name, append([]byte(nil), data...), 0o666)
+}
+
+// helper: replaces the content of a file; mu must be held
+func (m *MemFS) write(name string, data []byte, perm fs.FileMode) error {
+	key := memPath(name)
+	dir, err := m.parent("open", key)
+	if err != nil {
+		return err
+	}
+	if n, ok := m.nodes[key]; ok {
+		if n.children != nil {
+			return &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		}
+		n.data, n.modTime = data, time.Now()
+		return nil
+	}
+	n := &memNode{name: filepath.Base(key), data: data, mode: perm.Perm(), modTime: time.Now()}
+	m.nodes[key] = n
+	dir.children[n.name] = n
+	return nil
+}
+
+func (m *MemFS) Mkdir(name string, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memPath(name)
+	if _, ok := m.nodes[key]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	dir, err := m.parent("mkdir", key)
+	if err != nil {
+		return err
+	}
+	n := &memNode{name: filepath.Base(key), mode: fs.ModeDir | perm.Perm(), modTime: time.Now(), children: make(map[string]*memNode)}
+	m.nodes[key] = n
+	dir.children[n.name] = n
+	return nil
+}
+
+// Rename - moves a file or a whole directory, replacing a file at newpath
+func (m *MemFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	from, to := memPath(oldpath), memPath(newpath)
+	n, ok := m.nodes[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldpath, Err: fs.ErrNotExist}
+	}
+	if from == to {
+		return nil
+	}
+	dir, err := m.parent("rename", to)
+	if err != nil {
+		return err
+	}
+	if old, ok := m.nodes[to]; ok && (old.children != nil || n.children != nil) {
+		return &fs.PathError{Op: "rename", Path: newpath, Err: fs.ErrExist}
+	}
+	delete(m.nodes[memParent(from)].children, n.name)
+	moved := make(map[string]*memNode)
+	for key, c := range m.nodes {
+		if key == from || strings.HasPrefix(key, from+"/") {
+			moved[to+strings.TrimPrefix(key, from)] = c
+			delete(m.nodes, key)
+		}
+	}
+	for key, c := range moved {
+		m.nodes[key] = c
+	}
+	n.name = filepath.Base(to)
+	dir.children[n.name] = n
+	return nil
+}
+
+// Remove - removes a file or an empty directory
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memPath(name)
+	n, ok := m.nodes[key]
+	if !ok || key == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if len(n.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.nodes, key)
+	delete(m.nodes[memParent(key)].children, n.name)
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	n, ok := m.nodes[memPath(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return n.info(), nil
+}
+
+// memInfo - a snapshot of a node, as returned by Stat and ReadDir
+type memInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+// helper: mu must be held
+func (n *memNode) info() fs.FileInfo {
+	return memInfo{n.name, int64(len(n.data)), n.mode, n.modTime}
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return i.size }
+func (i memInfo) Mode() fs.FileMode  { return i.mode }
+func (i memInfo) ModTime() time.Time { return i.modTime }
+func (i memInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
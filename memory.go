@@ -0,0 +1,177 @@
+package simplejsondb
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// MemoryName - directory name of a database created by NewMemory within its MemFS
+const MemoryName = "memory"
+
+// NewMemory - a database living entirely in memory, with the same semantics as one on
+// disk; SaveTo and LoadFrom move it to and from the on-disk directory format
+func NewMemory(options ...Options) (DB, error) {
+	opts := Options{}
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	opts.FS = NewMemFS()
+	return New(MemoryName, &opts)
+}
+
+// SaveTo writes the database to the directory path on disk in the normal format,
+// replacing what path held. Writes through opened collections wait meanwhile.
+func (db *db) SaveTo(path string) error {
+	// a running snapshot is done first
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	cols := make([]*collection, 0, len(db.collections))
+	for _, c := range db.collections {
+		cols = append(cols, c)
+	}
+	defer lockAll(cols)()
+
+	tmp := path + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := copyTree(db.fs, db.path, OSFS{}, tmp); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	old := path + ".old"
+	if err := os.RemoveAll(old); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	moved := true
+	if err := os.Rename(path, old); errors.Is(err, fs.ErrNotExist) {
+		moved = false
+	} else if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		// put back what path held
+		if moved {
+			os.Rename(old, path)
+		}
+		os.RemoveAll(tmp)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+// LoadFrom replaces the content of the database with the database stored in the
+// directory path on disk. Collections opened before are dropped and must be opened
+// again: their handles return ErrDropped, and no records, from then on.
+func (db *db) LoadFrom(path string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	m, err := readMeta(OSFS{}, path)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return ErrNoDirectory
+	}
+	if _, err := checkDictionary(OSFS{}, path, m, db.codecs.dictionary(), true); err != nil {
+		return err
+	}
+
+	// a running snapshot is done first
+	db.snapMu.Lock()
+	defer db.snapMu.Unlock()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// writes through the dropped handles are done before the content goes
+	for name, c := range db.collections {
+		c.mu.Lock()
+		c.dropped.Store(true)
+		c.mu.Unlock()
+		c.stopWatcher()
+		if c.store != nil {
+			c.store.close()
+		}
+		delete(db.collections, name)
+	}
+	if err := removeAll(db.fs, db.path, true); err != nil {
+		return err
+	}
+	if err := copyTree(OSFS{}, path, db.fs, db.path); err != nil {
+		return err
+	}
+	if m, err = loadMeta(db.fs, db.path, m, strictness{}, false); err != nil {
+		return err
+	}
+	if m, err = checkDictionary(db.fs, db.path, m, db.codecs.dictionary(), false); err != nil {
+		return err
+	}
+	db.meta, db.compression = m, m.Compression
+	return nil
+}
+
+// instanceFile - reports whether a file belongs to the running database instance rather
+// than to its data: lock files and the operation log
+func instanceFile(name string) bool {
+	return name == LockFile || name == LockDir || name == OplogDir
+}
+
+// copyTree - copies the directory src of one file system to dst of another, leaving out
+// the instance files and whatever vanishes while it runs
+func copyTree(from FS, src string, to FS, dst string) error {
+	if err := mkdirAll(to, dst); err != nil {
+		return err
+	}
+	entries, err := from.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if instanceFile(name) {
+			continue
+		}
+		if e.IsDir() {
+			err = copyTree(from, filepath.Join(src, name), to, filepath.Join(dst, name))
+		} else {
+			var data []byte
+			if data, err = from.ReadFile(filepath.Join(src, name)); err == nil {
+				err = to.WriteFile(filepath.Join(dst, name), data, os.ModePerm)
+			}
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll - empties the directory path of fsys, keeping the directory itself and,
+// when keep is set, its instance files
+func removeAll(fsys FS, path string, keep bool) error {
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if keep && instanceFile(e.Name()) {
+			continue
+		}
+		sub := filepath.Join(path, e.Name())
+		if e.IsDir() {
+			if err := removeAll(fsys, sub, false); err != nil {
+				return err
+			}
+		}
+		if err := fsys.Remove(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
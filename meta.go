@@ -0,0 +1,157 @@
+package simplejsondb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// newMeta - metadata describing a new database or collection created with opts
+func newMeta(opts Options) *Metadata {
+	return &Metadata{
+		FormatVersion: FormatVersion,
+		Codec:         CodecJSON,
+		Compression:   compressionOf(opts),
+		Layout:        layoutOf(opts.Layout),
+		Engine:        engineOf(opts.Engine),
+		CreatedAt:     time.Now().UTC(),
+	}
+}
+
+// layoutOf - the layout named by an option or metadata value, flat when empty
+func layoutOf(layout string) string {
+	if layout == "" {
+		return LayoutFlat
+	}
+	return layout
+}
+
+// engineOf - the storage engine named by an option or metadata value, files when empty
+func engineOf(engine string) string {
+	if engine == "" {
+		return EngineFiles
+	}
+	return engine
+}
+
+// readMeta - reads the metadata file in dir, returns nil if there is none yet
+func readMeta(fsys FS, dir string) (*Metadata, error) {
+	data, err := fsys.ReadFile(filepath.Join(dir, MetaFile))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var m Metadata
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, MetaFile), err)
+	}
+	return &m, nil
+}
+
+// writeMeta - replaces the metadata file in dir
+func writeMeta(fsys FS, dir string, m *Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, MetaFile+".tmp")
+	if err := fsys.WriteFile(tmp, data, os.ModePerm); err != nil {
+		return err
+	}
+	return fsys.Rename(tmp, filepath.Join(dir, MetaFile))
+}
+
+// checkDictionary - the stored metadata of dir must name the zstd dictionary id of the
+// options, zero for none; metadata without one adopts it (persisted unless readOnly)
+func checkDictionary(fsys FS, dir string, m *Metadata, id uint32, readOnly bool) (*Metadata, error) {
+	switch {
+	case m.ZstdDict == id:
+		return m, nil
+	case m.ZstdDict != 0:
+		return nil, fmt.Errorf("%w: %s needs zstd dictionary %d, options give %s",
+			ErrIncompatibleOptions, dir, m.ZstdDict, dictName(id))
+	}
+	adopted := *m
+	adopted.ZstdDict = id
+	if !readOnly {
+		if err := writeMeta(fsys, dir, &adopted); err != nil {
+			return nil, err
+		}
+	}
+	return &adopted, nil
+}
+
+// helper: names a dictionary id in errors
+func dictName(id uint32) string {
+	if id == 0 {
+		return "none"
+	}
+	return fmt.Sprint(id)
+}
+
+// strictness - the format fields the options set explicitly, which the stored metadata
+// must agree with; fields left at their zero value adopt the stored format
+type strictness struct {
+	compression, layout, engine bool
+}
+
+// strictOf - the format fields set in opts; a read-only database never writes so it
+// simply adopts the stored format
+func strictOf(opts Options) strictness {
+	if opts.ReadOnly {
+		return strictness{}
+	}
+	return strictness{
+		compression: opts.Compression != "" || opts.UseGzip,
+		layout:      opts.Layout != "",
+		engine:      opts.Engine != "",
+	}
+}
+
+// loadMeta - returns the metadata stored in dir, falling back to def when missing
+// (persisted unless readOnly). The fields named by strict must agree with def, unless a
+// migration gave the stored metadata a format of its own.
+func loadMeta(fsys FS, dir string, def *Metadata, strict strictness, readOnly bool) (*Metadata, error) {
+	m, err := readMeta(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		if readOnly {
+			return def, nil
+		}
+		return def, writeMeta(fsys, dir, def)
+	}
+	if m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf("%w: %s has format version %d, supported up to %d",
+			ErrIncompatibleOptions, dir, m.FormatVersion, FormatVersion)
+	}
+	if m.Codec != "" && m.Codec != CodecJSON {
+		return nil, fmt.Errorf("%w: %s uses codec %q", ErrIncompatibleOptions, dir, m.Codec)
+	}
+	if m.Migrated {
+		strict = strictness{}
+	}
+	if strict.compression && m.Compression != def.Compression {
+		return nil, fmt.Errorf("%w: %s uses %q compression, options ask for %q",
+			ErrIncompatibleOptions, dir, m.Compression, def.Compression)
+	}
+	if strict.layout && layoutOf(m.Layout) != layoutOf(def.Layout) {
+		return nil, fmt.Errorf("%w: %s uses the %s layout, options ask for %s",
+			ErrIncompatibleOptions, dir, layoutOf(m.Layout), layoutOf(def.Layout))
+	}
+	// older files stay readable, the version keeps older releases from misreading new ones
+	if m.FormatVersion < FormatVersion && !readOnly {
+		m.FormatVersion = FormatVersion
+		if err := writeMeta(fsys, dir, m); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,214 @@
+package simplejsondb
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// MigrateProgress - how far a running Migrate got, reported after every record
+type MigrateProgress struct {
+	Key       string // the record just handled
+	Total     int    // records found when the migration started
+	Rewritten int    // records written in the target format
+	Skipped   int    // records already in the target format, or gone meanwhile
+}
+
+// Migrate rewrites every record of the collection in the format of target: its
+// Compression (or UseGzip), CompressMinSize and, when set, Layout. It runs online, new
+// writes use the target format right away, and is resumable: records already in the
+// target format are skipped, so an interrupted migration is completed by running it again.
+// Each record file is replaced atomically before its old variant is deleted. Records of
+// an encrypted collection are sealed with the current key as well, see RotateKey.
+func (c *collection) Migrate(target Options, progress ...func(MigrateProgress)) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	compression := compressionOf(target)
+	if c.codecs.byName(compression) == nil {
+		return ErrUnknownCompression
+	}
+	if target.Layout != "" && layoutOf(target.Layout) != c.layout {
+		if err := c.MigrateLayout(target.Layout); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	if c.dropped.Load() {
+		c.mu.Unlock()
+		return ErrDropped
+	}
+	meta := *c.meta
+	meta.Compression, meta.Migrated = compression, true
+	if err := writeMeta(c.fs, c.path, &meta); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.meta, c.compression = &meta, compression
+	if target.CompressMinSize > 0 {
+		c.compressMinSize = target.CompressMinSize
+	}
+	c.mu.Unlock()
+	return c.rewrite(progress)
+}
+
+// RotateKey re-encrypts every record not sealed with the current key of the collection's
+// KeyProvider, including records written before the collection was encrypted. It is
+// synchronous by design, like Migrate: it returns once every record is rewritten, the
+// error included, while reads and writes go on. Run it in a goroutine of your own for a
+// background rotation; being resumable, an interrupted one is completed by calling it
+// again. Retired keys must stay in the provider until it returns.
+func (c *collection) RotateKey(progress ...func(MigrateProgress)) error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.keys == nil {
+		return ErrNoKey
+	}
+	if err := c.rewrite(progress); err != nil {
+		return err
+	}
+	return c.markSealed()
+}
+
+// helper: records that every record of the collection is encrypted
+func (c *collection) markSealed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.meta.Sealed || c.dropped.Load() {
+		return nil
+	}
+	meta := *c.meta
+	meta.Sealed = true
+	if err := writeMeta(c.fs, c.path, &meta); err != nil {
+		return err
+	}
+	c.meta = &meta
+	return nil
+}
+
+// helper: rewrites the records not in the current format, reporting progress
+func (c *collection) rewrite(progress []func(MigrateProgress)) error {
+	var keys []string
+	if c.store != nil {
+		keys = c.store.list()
+	} else {
+		err := c.walk(func(dir string, r os.DirEntry) {
+			if key := recordKey(r.Name()); key != "" {
+				keys = append(keys, key)
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	p := MigrateProgress{Total: len(keys)}
+	for _, key := range keys {
+		rewritten, err := c.migrateRecord(key)
+		if err != nil {
+			return err
+		}
+		if rewritten {
+			p.Rewritten++
+		} else {
+			p.Skipped++
+		}
+		p.Key = key
+		for _, fn := range progress {
+			fn(p)
+		}
+	}
+	return nil
+}
+
+// helper: rewrites one record in the current format under the record lock, reporting
+// whether anything was written
+func (c *collection) migrateRecord(key string) (bool, error) {
+	release, err := c.lockRecord(key, ModeWrite, nil)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	unlock, err := c.lockForWrite(key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	target := c.codecs.byName(c.compression)
+	currentKey := ""
+	if c.keys != nil {
+		id, _, err := c.keys.CurrentKey()
+		if err != nil {
+			return false, err
+		}
+		currentKey = id
+	}
+	var value []byte
+	if c.store != nil {
+		data, flags, err := c.store.get(key)
+		if os.IsNotExist(err) {
+			return false, nil // deleted meanwhile
+		}
+		if err != nil {
+			return false, err
+		}
+		if c.segCodec(flags) == target && sealedWith(data, currentKey) {
+			return false, nil
+		}
+		if value, err = c.decode(key, data, c.segCodec(flags)); err != nil {
+			return false, err
+		}
+	} else {
+		filename, err, codec := c.getPathIfExist(key, nil)
+		if err != nil {
+			return false, nil // deleted meanwhile
+		}
+		data, err := c.fs.ReadFile(filename)
+		if err != nil {
+			return false, err
+		}
+		if codec == target && filepath.Dir(filename) == c.recordDir(key, c.layout) && sealedWith(data, currentKey) {
+			return false, nil
+		}
+		if value, err = c.decode(key, data, codec); err != nil {
+			return false, err
+		}
+	}
+
+	data, compression, err := c.encode(key, value, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.store != nil {
+		return true, c.store.put(key, data, segFlags[compression])
+	}
+
+	// the new variant is complete before it becomes visible, then the old one goes
+	filename := c.getFullPath(key, compression)
+	if err := mkdirAll(c.fs, filepath.Dir(filename)); err != nil {
+		return false, err
+	}
+	tmp := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := c.fs.WriteFile(tmp, data, os.ModePerm); err != nil {
+		return false, err
+	}
+	if err := c.fs.Rename(tmp, filename); err != nil {
+		c.fs.Remove(tmp)
+		return false, err
+	}
+	c.remember(filename)
+	c.removeVariants(key, filename)
+	return true, nil
+}
+
+// sealedWith - reports whether a stored payload is sealed with the key id, or is plain
+// when id is empty
+func sealedWith(data []byte, id string) bool {
+	if payload, err := verify(data); err == nil {
+		data = payload
+	}
+	sealed, ok := sealedKeyID(data)
+	return sealed == id && ok == (id != "")
+}
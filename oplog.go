@@ -0,0 +1,341 @@
+package simplejsondb
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultOplogMaxSize - size at which an oplog segment is rotated when OplogOptions.MaxSize is zero
+const DefaultOplogMaxSize = 64 << 20
+
+// OplogOptions - configuration of the database operation log
+type OplogOptions struct {
+	// Payload stores the written data, required to replay creates. It is refused for
+	// encrypted collections, the log is not encrypted.
+	Payload bool
+	// HashKey, when set, keys the HMAC-SHA256 stored with every written value, which
+	// tells changed values apart and is checked on replay. A plain hash would let
+	// anyone reading the log confirm guessed values.
+	HashKey []byte
+	// MaxSize rotates the current segment once it grows past it, DefaultOplogMaxSize when zero
+	MaxSize int64
+	// MaxFiles keeps at most this many segments, zero keeps all
+	MaxFiles int
+	// MaxAge drops segments last written longer ago, zero keeps all
+	MaxAge time.Duration
+	// Sync flushes every entry to stable storage before the write returns
+	Sync bool
+}
+
+// OplogEntry - one mutation recorded in the operation log
+type OplogEntry struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Collection string    `json:"collection"`
+	Key        string    `json:"key"`
+	Op         string    `json:"op"`
+	Hash       string    `json:"hash,omitempty"`    // HMAC-SHA256 of the payload under OplogOptions.HashKey
+	Payload    []byte    `json:"payload,omitempty"` // when OplogOptions.Payload is set
+}
+
+// oplog - append-only, segmented log of every mutation of a database
+type oplog struct {
+	mu   sync.Mutex
+	dir  string
+	opts OplogOptions
+	seq  uint64
+	file *os.File
+	size int64
+}
+
+// openOplog - opens the log in dir, continuing the sequence of its last entry
+func openOplog(dir string, opts OplogOptions) (*oplog, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultOplogMaxSize
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	seq, err := lastOplogSeq(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &oplog{dir: dir, opts: opts, seq: seq}, nil
+}
+
+// lastOplogSeq - sequence number of the last entry logged in dir, zero for an empty log.
+// Segments left empty, e.g. by a crash right after rotate, are read past; the name of
+// the last one still bounds it, its first entry was to follow the last one logged.
+func lastOplogSeq(dir string) (seq uint64, err error) {
+	segments, err := oplogSegments(dir)
+	if err != nil || len(segments) == 0 {
+		return 0, err
+	}
+	if first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(segments[len(segments)-1]), OplogExt), 10, 64); err == nil && first > 0 {
+		seq = first - 1
+	}
+	for i := len(segments) - 1; i >= 0; i-- {
+		found := false
+		err := readSegment(segments[i], func(e OplogEntry) error {
+			found = true
+			seq = max(seq, e.Seq)
+			return nil
+		})
+		if err != nil || found {
+			return seq, err
+		}
+	}
+	return seq, nil
+}
+
+// append - records a mutation, rotating and pruning segments as configured
+func (l *oplog) append(collection, key, op string, payload []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := OplogEntry{Seq: l.seq + 1, Time: time.Now().UTC(), Collection: collection, Key: key, Op: op}
+	if payload != nil {
+		if len(l.opts.HashKey) > 0 {
+			e.Hash = oplogHash(l.opts.HashKey, payload)
+		}
+		if l.opts.Payload {
+			e.Payload = payload
+		}
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if l.file == nil || l.size+int64(len(line)) > l.opts.MaxSize {
+		if err := l.rotate(e.Seq); err != nil {
+			return err
+		}
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	if l.opts.Sync {
+		if err := l.file.Sync(); err != nil {
+			return err
+		}
+	}
+	l.size += int64(len(line))
+	l.seq = e.Seq
+	return nil
+}
+
+// oplogHash - the keyed hash of a logged payload
+func oplogHash(key, payload []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// helper: starts a new segment named after its first sequence number; mu must be held
+func (l *oplog) rotate(seq uint64) error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+	}
+	name := filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, OplogExt))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return l.prune()
+}
+
+// helper: applies the retention policy, never dropping the current segment; mu must be held
+func (l *oplog) prune() error {
+	segments, err := oplogSegments(l.dir)
+	if err != nil {
+		return err
+	}
+	segments = segments[:len(segments)-1]
+	keep := len(segments)
+	if l.opts.MaxFiles > 0 && keep > l.opts.MaxFiles-1 {
+		keep = l.opts.MaxFiles - 1
+	}
+	for i, s := range segments {
+		old := i < len(segments)-keep
+		if !old && l.opts.MaxAge > 0 {
+			if info, err := os.Stat(s); err == nil && time.Since(info.ModTime()) > l.opts.MaxAge {
+				old = true
+			}
+		}
+		if old {
+			if err := os.Remove(s); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *oplog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// oplogSegments - segment files of the log in sequence order
+func oplogSegments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), OplogExt) {
+			segments = append(segments, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func readSegment(path string, fn func(OplogEntry) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e OplogEntry
+			if jerr := json.Unmarshal(line, &e); jerr != nil {
+				return fmt.Errorf("%s: %w", path, jerr)
+			}
+			if ferr := fn(e); ferr != nil {
+				return ferr
+			}
+		}
+		if err != nil {
+			return nil // a torn last line is skipped
+		}
+	}
+}
+
+// errOplogEnd - returned by fn to end ReadOplog early without an error
+var errOplogEnd = errors.New("end of oplog")
+
+// ReadOplog calls fn for every logged mutation with a sequence number of at least from
+func (db *db) ReadOplog(from uint64, fn func(OplogEntry) error) error {
+	segments, err := oplogSegments(filepath.Join(db.path, OplogDir))
+	if err != nil {
+		return err
+	}
+	for i, s := range segments {
+		// skip segments entirely before from, the next one starts past it
+		if i+1 < len(segments) {
+			var next uint64
+			fmt.Sscanf(filepath.Base(segments[i+1]), "%d", &next)
+			if next <= from {
+				continue
+			}
+		}
+		err := readSegment(s, func(e OplogEntry) error {
+			if e.Seq < from {
+				return nil
+			}
+			return fn(e)
+		})
+		if err == errOplogEnd {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReplayOplog applies the logged mutations from sequence number from onwards to
+// target, or to this database when target is nil, optionally limited to some collections.
+// Creates can only be replayed from a log written with OplogOptions.Payload. Only the
+// entries logged when the replay starts are applied, not the ones the replay itself logs.
+func (db *db) ReplayOplog(from uint64, target DB, collections ...string) error {
+	if target == nil {
+		target = db
+	}
+	last, err := lastOplogSeq(filepath.Join(db.path, OplogDir))
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool)
+	for _, name := range collections {
+		wanted[name] = true
+	}
+	return db.ReadOplog(from, func(e OplogEntry) error {
+		if e.Seq > last {
+			return errOplogEnd
+		}
+		if len(wanted) > 0 && !wanted[e.Collection] {
+			return nil
+		}
+		c, err := target.Collection(e.Collection)
+		if err != nil {
+			return err
+		}
+		switch e.Op {
+		case OpCreate:
+			if e.Payload == nil {
+				return fmt.Errorf("%w: entry %d has no payload", ErrNoPayload, e.Seq)
+			}
+			if err := db.checkOplogHash(e); err != nil {
+				return err
+			}
+			return c.Create(e.Key, e.Payload)
+		case OpDelete:
+			if err := c.Delete(e.Key); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// helper: verifies the hash of a logged payload with the HashKey of the database
+func (db *db) checkOplogHash(e OplogEntry) error {
+	if e.Hash == "" {
+		return nil
+	}
+	if db.opts.Oplog == nil || len(db.opts.Oplog.HashKey) == 0 {
+		return fmt.Errorf("oplog entry %d: no OplogOptions.HashKey to check its hash", e.Seq)
+	}
+	if !hmac.Equal([]byte(oplogHash(db.opts.Oplog.HashKey, e.Payload)), []byte(e.Hash)) {
+		return fmt.Errorf("oplog entry %d: payload does not match its hash", e.Seq)
+	}
+	return nil
+}
@@ -0,0 +1,746 @@
+package simplejsondb
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage engines of a collection
+const (
+	// EngineFiles keeps one file per record.
+	EngineFiles = "files"
+	// EngineSegment appends records to segment files indexed by an in-memory key
+	// directory, Bitcask style.
+	EngineSegment = "segment"
+)
+
+// Segment engine defaults, used when the matching SegmentOptions field is zero
+const (
+	DefaultSegmentMaxSize = 64 << 20
+	DefaultMergeInterval  = time.Minute
+	DefaultMergeRatio     = 0.5
+)
+
+// SegmentOptions - configuration of the segment storage engine
+type SegmentOptions struct {
+	// MaxSize seals the active segment once it grows past it, DefaultSegmentMaxSize when zero
+	MaxSize int64
+	// MergeInterval is how often the background merge checks the segments,
+	// DefaultMergeInterval when zero; a negative interval disables it
+	MergeInterval time.Duration
+	// MergeRatio is the share of stale bytes which triggers a background merge,
+	// DefaultMergeRatio when zero
+	MergeRatio float64
+	// Sync flushes every entry to stable storage before the write returns
+	Sync bool
+}
+
+// segment entry flags
+const (
+	segTombstone byte = 1 << iota
+	segGzip
+	segZstd
+	segSnappy
+)
+
+// segFlags - the flag recording the compression of an entry
+var segFlags = map[string]byte{CompressionGzip: segGzip, CompressionZstd: segZstd, CompressionSnappy: segSnappy}
+
+// segCodec - the compressor of an entry written with flags
+func (c *collection) segCodec(flags byte) compressor {
+	for name, f := range segFlags {
+		if flags&f != 0 {
+			return c.codecs.byName(name)
+		}
+	}
+	return c.codecs.byName(CompressionNone)
+}
+
+// segHeaderSize - crc32, flags, sequence number, key length and value length
+const segHeaderSize = 4 + 1 + 8 + 4 + 4
+
+// segEntry - where the latest entry of a key is, as kept in the key directory
+type segEntry struct {
+	seg    uint64
+	offset int64
+	seq    uint64
+	keyLen uint32
+	valLen uint32
+	flags  byte
+}
+
+func (e segEntry) size() int64 {
+	return segHeaderSize + int64(e.keyLen) + int64(e.valLen)
+}
+
+// segmentStore - append-only segment files of a collection; the key directory maps every
+// live key to its latest entry and is rebuilt from hint files (or the segments) on open
+type segmentStore struct {
+	mu     sync.RWMutex
+	dir    string
+	opts   SegmentOptions
+	keys   map[string]segEntry
+	files  map[uint64]*os.File // opened for reading
+	sizes  map[uint64]int64
+	dead   map[uint64]int64 // bytes no longer referenced by the key directory
+	seq    uint64
+	next   uint64 // id of the next segment
+	active uint64
+	w      *os.File
+	lock   *fileLock
+
+	merging sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// openSegmentStore - opens the segments in dir, rebuilding the key directory. Only one
+// instance may write the segments, a read-only store neither locks nor modifies them.
+func openSegmentStore(dir string, opts SegmentOptions, readOnly bool) (*segmentStore, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultSegmentMaxSize
+	}
+	if opts.MergeInterval == 0 {
+		opts.MergeInterval = DefaultMergeInterval
+	}
+	if opts.MergeRatio <= 0 {
+		opts.MergeRatio = DefaultMergeRatio
+	}
+	s := &segmentStore{
+		dir:   dir,
+		opts:  opts,
+		keys:  make(map[string]segEntry),
+		files: make(map[uint64]*os.File),
+		sizes: make(map[uint64]int64),
+		dead:  make(map[uint64]int64),
+	}
+	if !readOnly {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return nil, err
+		}
+		// the key directory lives in memory, so a second writer would miss our entries
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		l, err := lockFile(ctx, OSFS{}, filepath.Join(dir, LockFile), true, false)
+		if errors.Is(err, context.Canceled) {
+			return nil, fmt.Errorf("%w: segments of %s are opened elsewhere", ErrLockBusy, dir)
+		}
+		if err != nil {
+			return nil, err
+		}
+		s.lock = l
+	}
+	if err := s.load(readOnly); err != nil {
+		s.close()
+		return nil, err
+	}
+	if readOnly {
+		return s, nil
+	}
+	if err := s.rotate(); err != nil {
+		s.close()
+		return nil, err
+	}
+	if opts.MergeInterval > 0 {
+		s.stop, s.done = make(chan struct{}), make(chan struct{})
+		go s.mergeLoop()
+	}
+	return s, nil
+}
+
+// load - rebuilds the key directory; the entry with the highest sequence number of a key wins
+func (s *segmentStore) load(readOnly bool) error {
+	ids, err := segmentIDs(s.dir, readOnly)
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]uint64)
+	for i, id := range ids {
+		f, err := os.Open(s.segPath(id, SegmentExt))
+		if err != nil {
+			return err
+		}
+		s.files[id] = f
+		apply := func(key string, e segEntry) {
+			if e.seq > s.seq {
+				s.seq = e.seq
+			}
+			if cur, ok := s.keys[key]; ok && cur.seq > e.seq || deleted[key] > e.seq {
+				return
+			}
+			if e.flags&segTombstone != 0 {
+				delete(s.keys, key)
+				deleted[key] = e.seq
+				return
+			}
+			s.keys[key] = e
+		}
+		size, err := readHints(s.segPath(id, HintExt), id, apply)
+		if os.IsNotExist(err) {
+			size, err = scanSegment(f, id, apply)
+			if errors.Is(err, ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+				// a torn write at the tail of the last segment is dropped, anything
+				// else is reported and the rest of the segment skipped
+				log.Printf("segment %s: %v after %d bytes", f.Name(), err, size)
+				if i == len(ids)-1 && !readOnly {
+					err = os.Truncate(f.Name(), size)
+				} else {
+					err = nil
+				}
+			} else if err == nil && !readOnly {
+				// a new active segment is started on open, this one stays sealed
+				err = s.writeHints(id)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		s.sizes[id] = size
+		s.next = id + 1
+	}
+	// everything not referenced by the key directory is stale
+	live := make(map[uint64]int64)
+	for _, e := range s.keys {
+		live[e.seg] += e.size()
+	}
+	for id, size := range s.sizes {
+		s.dead[id] = size - live[id]
+	}
+	return nil
+}
+
+// segmentIDs - ids of the segment files in dir in ascending order; leftovers of an
+// interrupted merge are removed unless readOnly
+func segmentIDs(dir string, readOnly bool) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasSuffix(name, ".tmp") && !readOnly {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		var id uint64
+		if _, err := fmt.Sscanf(name, "%020d"+SegmentExt, &id); err == nil && strings.HasSuffix(name, SegmentExt) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+func (s *segmentStore) segPath(id uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, ext))
+}
+
+// encodeEntry - header, key and value of one segment entry
+func encodeEntry(key string, value []byte, seq uint64, flags byte) []byte {
+	buf := make([]byte, segHeaderSize+len(key)+len(value))
+	buf[4] = flags
+	binary.BigEndian.PutUint64(buf[5:], seq)
+	binary.BigEndian.PutUint32(buf[13:], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[17:], uint32(len(value)))
+	copy(buf[segHeaderSize:], key)
+	copy(buf[segHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// scanSegment - reads every entry of a segment, returning the size of its valid part
+func scanSegment(f *os.File, id uint64, fn func(string, segEntry)) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, 1<<62))
+	var offset int64
+	header := make([]byte, segHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return offset, io.ErrUnexpectedEOF
+		}
+		e := segEntry{
+			seg:    id,
+			offset: offset,
+			flags:  header[4],
+			seq:    binary.BigEndian.Uint64(header[5:]),
+			keyLen: binary.BigEndian.Uint32(header[13:]),
+			valLen: binary.BigEndian.Uint32(header[17:]),
+		}
+		body := make([]byte, int(e.keyLen)+int(e.valLen))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return offset, io.ErrUnexpectedEOF
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, body)
+		if crc != binary.BigEndian.Uint32(header) {
+			return offset, ErrChecksum
+		}
+		fn(string(body[:e.keyLen]), e)
+		offset += e.size()
+	}
+}
+
+// hint records: flags, sequence number, key length, value length, offset and key
+const hintHeaderSize = 1 + 8 + 4 + 4 + 8
+
+// readHints - loads the key directory entries of a sealed segment from its hint file,
+// returning the segment size
+func readHints(path string, id uint64, fn func(string, segEntry)) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var size int64
+	header := make([]byte, hintHeaderSize)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return size, nil
+			}
+			return 0, fmt.Errorf("%s: %w", path, io.ErrUnexpectedEOF)
+		}
+		e := segEntry{
+			seg:    id,
+			flags:  header[0],
+			seq:    binary.BigEndian.Uint64(header[1:]),
+			keyLen: binary.BigEndian.Uint32(header[9:]),
+			valLen: binary.BigEndian.Uint32(header[13:]),
+			offset: int64(binary.BigEndian.Uint64(header[17:])),
+		}
+		key := make([]byte, e.keyLen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return 0, fmt.Errorf("%s: %w", path, io.ErrUnexpectedEOF)
+		}
+		fn(string(key), e)
+		if end := e.offset + e.size(); end > size {
+			size = end
+		}
+	}
+}
+
+// writeHints - writes the hint file of a sealed segment from its entries
+func (s *segmentStore) writeHints(id uint64) error {
+	f, err := os.Open(s.segPath(id, SegmentExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var buf []byte
+	_, err = scanSegment(f, id, func(key string, e segEntry) {
+		buf = appendHint(buf, key, e)
+	})
+	if err != nil {
+		return err
+	}
+	tmp := s.segPath(id, HintExt+".tmp")
+	if err := os.WriteFile(tmp, buf, 0o666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.segPath(id, HintExt))
+}
+
+// checkHints - calls fn for every sealed segment whose hint file disagrees with the
+// segment itself, rewriting the hint file when repair is set
+func (s *segmentStore) checkHints(fn func(path, detail string, repaired bool), repair bool) error {
+	s.merging.Lock()
+	defer s.merging.Unlock()
+	s.mu.RLock()
+	var ids []uint64
+	for id := range s.files {
+		if id != s.active {
+			ids = append(ids, id)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	for _, id := range ids {
+		var hints, entries []byte
+		_, err := readHints(s.segPath(id, HintExt), id, func(key string, e segEntry) {
+			hints = appendHint(hints, key, e)
+		})
+		if os.IsNotExist(err) {
+			continue // the segment is scanned instead
+		}
+		detail := "hint file does not match the segment"
+		if err != nil {
+			detail = err.Error()
+		} else {
+			f, err := os.Open(s.segPath(id, SegmentExt))
+			if err != nil {
+				return err
+			}
+			_, err = scanSegment(f, id, func(key string, e segEntry) {
+				entries = appendHint(entries, key, e)
+			})
+			f.Close()
+			if err != nil {
+				detail = err.Error()
+			} else if string(hints) == string(entries) {
+				continue
+			}
+		}
+		fn(s.segPath(id, HintExt), detail, repair && s.writeHints(id) == nil)
+	}
+	return nil
+}
+
+func appendHint(buf []byte, key string, e segEntry) []byte {
+	var header [hintHeaderSize]byte
+	header[0] = e.flags
+	binary.BigEndian.PutUint64(header[1:], e.seq)
+	binary.BigEndian.PutUint32(header[9:], e.keyLen)
+	binary.BigEndian.PutUint32(header[13:], e.valLen)
+	binary.BigEndian.PutUint64(header[17:], uint64(e.offset))
+	return append(append(buf, header[:]...), key...)
+}
+
+// helper: seals the active segment, writing its hint file, and starts a new one; mu must be held
+func (s *segmentStore) rotate() error {
+	if s.w != nil {
+		if err := s.w.Close(); err != nil {
+			return err
+		}
+		s.w = nil
+		if err := s.writeHints(s.active); err != nil {
+			return err
+		}
+	}
+	id := s.next
+	w, err := os.OpenFile(s.segPath(id, SegmentExt), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o666)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(w.Name())
+	if err != nil {
+		w.Close()
+		return err
+	}
+	s.w, s.active, s.next = w, id, id+1
+	s.files[id], s.sizes[id], s.dead[id] = r, 0, 0
+	return nil
+}
+
+// put - appends a value, or a tombstone when value is nil, for key
+func (s *segmentStore) put(key string, value []byte, flags byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.w == nil {
+		return ErrReadOnly
+	}
+	if s.sizes[s.active] >= s.opts.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	buf := encodeEntry(key, value, s.seq+1, flags)
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	if s.opts.Sync {
+		if err := s.w.Sync(); err != nil {
+			return err
+		}
+	}
+	s.seq++
+	e := segEntry{
+		seg:    s.active,
+		offset: s.sizes[s.active],
+		seq:    s.seq,
+		keyLen: uint32(len(key)),
+		valLen: uint32(len(value)),
+		flags:  flags,
+	}
+	s.sizes[s.active] += e.size()
+	if cur, ok := s.keys[key]; ok {
+		s.dead[cur.seg] += cur.size()
+	}
+	if flags&segTombstone != 0 {
+		delete(s.keys, key)
+		s.dead[s.active] += e.size()
+		return nil
+	}
+	s.keys[key] = e
+	return nil
+}
+
+// get - the latest value of key and its flags
+func (s *segmentStore) get(key string) ([]byte, byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.keys[key]
+	if !ok {
+		return nil, 0, os.ErrNotExist
+	}
+	value, err := s.read(e)
+	return value, e.flags, err
+}
+
+// helper: reads and verifies the value of an entry; mu must be held
+func (s *segmentStore) read(e segEntry) ([]byte, error) {
+	buf := make([]byte, e.size())
+	if _, err := s.files[e.seg].ReadAt(buf, e.offset); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(buf[4:]) != binary.BigEndian.Uint32(buf) {
+		return nil, fmt.Errorf("%s at %d: %w", s.files[e.seg].Name(), e.offset, ErrChecksum)
+	}
+	return buf[segHeaderSize+int64(e.keyLen):], nil
+}
+
+// has - reports whether key is live
+func (s *segmentStore) has(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.keys[key]
+	return ok
+}
+
+// each - calls fn with every live record in key order, skipping unreadable ones
+func (s *segmentStore) each(fn func(key string, value []byte, flags byte)) {
+	for _, key := range s.list() {
+		if value, flags, err := s.get(key); err == nil {
+			fn(key, value, flags)
+		}
+	}
+}
+
+// list - the live keys in order
+func (s *segmentStore) list() []string {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.keys))
+	for k := range s.keys {
+		keys = append(keys, k)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *segmentStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.keys)
+}
+
+// mergeLoop - merges the sealed segments whenever enough of the data is stale
+func (s *segmentStore) mergeLoop() {
+	defer close(s.done)
+	t := time.NewTicker(s.opts.MergeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+			s.mu.RLock()
+			var total, dead int64
+			for id, size := range s.sizes {
+				total += size
+				dead += s.dead[id]
+			}
+			s.mu.RUnlock()
+			if total > 0 && float64(dead)/float64(total) >= s.opts.MergeRatio {
+				if err := s.merge(); err != nil {
+					log.Printf("segment merge %s: %v", s.dir, err)
+				}
+			}
+		}
+	}
+}
+
+// merge - seals the active segment and rewrites the live entries of all sealed
+// segments into new ones, dropping stale values and tombstones. Writes go on
+// meanwhile; entries superseded during the merge are counted as stale.
+func (s *segmentStore) merge() error {
+	s.merging.Lock()
+	defer s.merging.Unlock()
+
+	s.mu.Lock()
+	if s.w == nil {
+		s.mu.Unlock()
+		return ErrReadOnly
+	}
+	if s.sizes[s.active] > 0 {
+		if err := s.rotate(); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+	}
+	var sealed []uint64
+	for id := range s.files {
+		if id != s.active {
+			sealed = append(sealed, id)
+		}
+	}
+	type move struct {
+		key      string
+		from, to segEntry
+	}
+	var moves []move
+	for k, e := range s.keys {
+		if e.seg != s.active {
+			moves = append(moves, move{key: k, from: e})
+		}
+	}
+	s.mu.Unlock()
+	if len(sealed) == 0 {
+		return nil
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].from.seq < moves[j].from.seq })
+
+	// the sealed segments are immutable, so they are copied without holding mu
+	var out *os.File
+	var outID uint64
+	var outSize int64
+	var hints []byte
+	var written []uint64
+	finish := func() error {
+		if out == nil {
+			return nil
+		}
+		err := out.Sync()
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.WriteFile(s.segPath(outID, HintExt+".tmp"), hints, 0o666)
+		}
+		out, hints = nil, nil
+		return err
+	}
+	for i := range moves {
+		if out == nil || outSize >= s.opts.MaxSize {
+			if err := finish(); err != nil {
+				return err
+			}
+			s.mu.Lock()
+			outID = s.next
+			s.next++
+			s.mu.Unlock()
+			f, err := os.OpenFile(s.segPath(outID, SegmentExt+".tmp"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o666)
+			if err != nil {
+				return err
+			}
+			out, outSize = f, 0
+			written = append(written, outID)
+		}
+		m := &moves[i]
+		buf := make([]byte, m.from.size())
+		s.mu.RLock()
+		_, err := s.files[m.from.seg].ReadAt(buf, m.from.offset)
+		s.mu.RUnlock()
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if _, err := out.Write(buf); err != nil {
+			out.Close()
+			return err
+		}
+		m.to = m.from
+		m.to.seg, m.to.offset = outID, outSize
+		hints = appendHint(hints, m.key, m.to)
+		outSize += m.to.size()
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range written {
+		for _, ext := range []string{HintExt, SegmentExt} {
+			if err := os.Rename(s.segPath(id, ext+".tmp"), s.segPath(id, ext)); err != nil {
+				return err
+			}
+		}
+		f, err := os.Open(s.segPath(id, SegmentExt))
+		if err != nil {
+			return err
+		}
+		s.files[id], s.sizes[id], s.dead[id] = f, 0, 0
+	}
+	for _, m := range moves {
+		s.sizes[m.to.seg] += m.to.size()
+		if s.keys[m.key] == m.from {
+			s.keys[m.key] = m.to
+		} else {
+			s.dead[m.to.seg] += m.to.size()
+		}
+	}
+	// oldest first: should this stop halfway, no tombstone outlives the value it hides
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i] < sealed[j] })
+	for _, id := range sealed {
+		s.files[id].Close()
+		delete(s.files, id)
+		delete(s.sizes, id)
+		delete(s.dead, id)
+		os.Remove(s.segPath(id, HintExt))
+		if err := os.Remove(s.segPath(id, SegmentExt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close - stops the background merge and closes the segment files
+func (s *segmentStore) close() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.done
+		s.stop = nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.w != nil {
+		err = s.w.Close()
+		s.w = nil
+	}
+	for id, f := range s.files {
+		f.Close()
+		delete(s.files, id)
+	}
+	if s.lock != nil {
+		if lerr := s.lock.unlock(); err == nil {
+			err = lerr
+		}
+		s.lock = nil
+	}
+	return err
+}
+
+// Compact merges the segment files of a collection using EngineSegment, dropping
+// overwritten and deleted records; the file engine has nothing to compact
+func (c *collection) Compact() error {
+	if c.readOnly {
+		return ErrReadOnly
+	}
+	if c.dropped.Load() {
+		return ErrDropped
+	}
+	if c.store == nil {
+		return nil
+	}
+	return c.store.merge()
+}
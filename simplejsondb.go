@@ -1,53 +1,288 @@
 package simplejsondb
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // New - a database instance
-func New(dbname string, options *Options) (DB, error) {
+func New(dbname string, options *Options) (_ DB, err error) {
 	opts := Options{}
 	if options != nil {
 		opts = *options
 	}
 
+	if l := layoutOf(opts.Layout); l != LayoutFlat && l != LayoutSharded {
+		return nil, ErrUnknownLayout
+	}
+	if e := engineOf(opts.Engine); e != EngineFiles && e != EngineSegment {
+		return nil, ErrUnknownEngine
+	}
+	codecs, err := newCodecs(opts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			codecs.close()
+		}
+	}()
+	if codecs.byName(compressionOf(opts)) == nil {
+		return nil, ErrUnknownCompression
+	}
+
+	fsys := fsOf(opts.FS)
+	// these keep files open, which only the OS file system offers
+	if !isOS(fsys) && (opts.Oplog != nil || engineOf(opts.Engine) == EngineSegment) {
+		return nil, ErrNotSupported
+	}
+
 	dbpath := filepath.Join(dbname)
-	_, err := getOrCreateDir(dbpath)
+	dir, err := getDir(fsys, dbpath, !opts.ReadOnly)
 	if err != nil {
 		return nil, err
 	}
+	if !dir.IsDir() {
+		return nil, ErrNoDirectory
+	}
+
+	// format options set explicitly must agree with what the database was created with
+	strict := strictOf(opts)
+	def := newMeta(opts)
+	def.ZstdDict = codecs.dictionary()
+	meta, err := loadMeta(fsys, dbpath, def, strict, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	// zstd records written with a dictionary cannot be read without it
+	if meta, err = checkDictionary(fsys, dbpath, meta, def.ZstdDict, opts.ReadOnly); err != nil {
+		return nil, err
+	}
+	// collections may choose their own engine, so only the database default is compared
+	if strict.engine && engineOf(meta.Engine) != engineOf(opts.Engine) {
+		return nil, fmt.Errorf("%w: %s uses the %s engine, options ask for %s",
+			ErrIncompatibleOptions, dbpath, engineOf(meta.Engine), engineOf(opts.Engine))
+	}
 
-	return &db{path: dbpath, useGzip: opts.UseGzip}, nil
+	var log *oplog
+	if opts.Oplog != nil && !opts.ReadOnly {
+		if log, err = openOplog(filepath.Join(dbpath, OplogDir), *opts.Oplog); err != nil {
+			return nil, err
+		}
+	}
+
+	return &db{
+		fs:          fsys,
+		oplog:       log,
+		path:        dbpath,
+		compression: meta.Compression,
+		codecs:      codecs,
+		readOnly:    opts.ReadOnly,
+		strict:      strict,
+		opts:        opts,
+		meta:        meta,
+		collections: make(map[string]*collection),
+	}, nil
 }
 
-// Collection returns the collection or table
-func (db *db) Collection(name string) (Collection, error) {
+// Collection returns the collection or table. Options may pick the Engine (and its
+// Segment configuration) and the Encryption of the collection, other fields come from
+// the database.
+func (db *db) Collection(name string, options ...Options) (Collection, error) {
+	engine, segOpts, keys := db.meta.Engine, db.opts.Segment, db.opts.Encryption
+	if len(options) > 0 {
+		if options[0].Engine != "" {
+			engine = options[0].Engine
+		}
+		if options[0].Segment != nil {
+			segOpts = options[0].Segment
+		}
+		if options[0].Encryption != nil {
+			keys = options[0].Encryption
+		}
+	}
+	if e := engineOf(engine); e != EngineFiles && e != EngineSegment {
+		return nil, ErrUnknownEngine
+	}
+	if engineOf(engine) == EngineSegment && !isOS(db.fs) {
+		return nil, ErrNotSupported
+	}
+	// an engine asked for explicitly must be the one the collection was created with
+	explicit := len(options) > 0 && options[0].Engine != ""
+	checkEngine := func(meta *Metadata) error {
+		if explicit && engineOf(meta.Engine) != engineOf(engine) {
+			return fmt.Errorf("%w: collection %s uses the %s engine, options ask for %s",
+				ErrIncompatibleOptions, name, engineOf(meta.Engine), engineOf(engine))
+		}
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if c, ok := db.collections[name]; ok {
+		if err := checkEngine(c.meta); err != nil {
+			return nil, err
+		}
+		// the keys of an opened collection are fixed, rotation happens within the provider
+		if len(options) > 0 && options[0].Encryption != nil && !sameKeys(options[0].Encryption, c.keys) {
+			return nil, fmt.Errorf("%w: collection %s is open with another key provider",
+				ErrIncompatibleOptions, name)
+		}
+		return c, nil
+	}
+
+	// other processes may be creating the same collection
+	if !db.readOnly {
+		l, err := lockFile(context.Background(), db.fs, filepath.Join(db.path, LockFile), true, false)
+		if err != nil {
+			return nil, err
+		}
+		defer l.unlock()
+	}
+
 	c := filepath.Join(db.path, name)
-	dir, err := getOrCreateDir(c)
+	dir, err := getDir(db.fs, c, !db.readOnly)
 	if err != nil {
 		return nil, err
 	}
 	if !dir.IsDir() {
 		return nil, ErrNoDirectory
 	}
-	return &collection{name: name, path: c, useGzip: db.useGzip}, nil
-}
 
-func getOrCreateDir(path string) (os.FileInfo, error) {
-	f, err := os.Stat(path)
+	// a new collection inherits the database format
+	def := &Metadata{
+		FormatVersion: FormatVersion,
+		Codec:         db.meta.Codec,
+		Compression:   db.meta.Compression,
+		Layout:        db.meta.Layout,
+		Engine:        engine,
+		ZstdDict:      db.codecs.dictionary(),
+		CreatedAt:     time.Now().UTC(),
+	}
+	if keys != nil {
+		def.Encryption = EncryptionAESGCM
+		// a collection encrypted from the start never holds plain records
+		entries, err := db.fs.ReadDir(c)
+		def.Sealed = err == nil && len(entries) == 0
+	}
+	meta, err := loadMeta(db.fs, c, def, db.strict, db.readOnly)
 	if err != nil {
-		if os.IsNotExist(err) {
-			cwd, err := os.Getwd()
-			if err != nil {
-				return nil, err
+		return nil, err
+	}
+	if meta, err = checkDictionary(db.fs, c, meta, def.ZstdDict, db.readOnly); err != nil {
+		return nil, err
+	}
+	if err := checkEngine(meta); err != nil {
+		return nil, err
+	}
+	// records written from now on are sealed, older ones are read as they are until
+	// RotateKey has rewritten them
+	if keys != nil && meta.Encryption == "" && !db.readOnly {
+		m := *meta
+		m.Encryption, m.Sealed = EncryptionAESGCM, false
+		if err := writeMeta(db.fs, c, &m); err != nil {
+			return nil, err
+		}
+		meta = &m
+	}
+	// the oplog is not encrypted
+	if db.oplog != nil && db.oplog.opts.Payload && meta.Encryption != "" {
+		return nil, fmt.Errorf("%w: oplog payloads would hold the records of encrypted collection %s in the clear",
+			ErrIncompatibleOptions, name)
+	}
+
+	col := &collection{
+		fs:              db.fs,
+		name:            name,
+		path:            c,
+		compression:     meta.Compression,
+		codecs:          db.codecs,
+		compressMinSize: db.opts.CompressMinSize,
+		readOnly:        db.readOnly,
+		layout:          layoutOf(meta.Layout),
+		engine:          engineOf(meta.Engine),
+		keys:            keys,
+		meta:            meta,
+		changeLog:       db.opts.ChangeLog,
+		changeMaxSize:   db.opts.ChangeLogMaxSize,
+		dbHooks:         &db.hooks,
+		oplog:           db.oplog,
+	}
+	if col.changeMaxSize <= 0 {
+		col.changeMaxSize = DefaultChangeLogMaxSize
+	}
+	if col.engine == EngineSegment {
+		if segOpts == nil {
+			segOpts = &SegmentOptions{}
+		}
+		if col.store, err = openSegmentStore(filepath.Join(c, SegmentDir), *segOpts, db.readOnly); err != nil {
+			return nil, err
+		}
+	} else if db.opts.ExternalWatch != WatchOff {
+		if err := col.startWatcher(db.opts.ExternalWatch, db.opts.PollInterval); err != nil {
+			return nil, err
+		}
+	}
+	if db.snapping {
+		db.snapCols = append(db.snapCols, col)
+		col.join()
+	}
+	db.collections[name] = col
+	return col, nil
+}
+
+// Close stops the background work of the opened collections
+func (db *db) Close() (err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, c := range db.collections {
+		if cerr := c.stopWatcher(); cerr != nil && err == nil {
+			err = cerr
+		}
+		if c.store != nil {
+			if cerr := c.store.close(); cerr != nil && err == nil {
+				err = cerr
 			}
-			newDir := filepath.Join(cwd, path)
-			err = os.Mkdir(filepath.Join(cwd, path), os.ModePerm)
+		}
+	}
+	if db.oplog != nil {
+		if cerr := db.oplog.close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if cerr := db.codecs.close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Meta returns the persisted database metadata
+func (db *db) Meta() Metadata {
+	return *db.meta
+}
+
+// getDir - stats path, creating the directory when missing and create is set
+func getDir(fsys FS, path string, create bool) (fs.FileInfo, error) {
+	if create {
+		return getOrCreateDir(fsys, path)
+	}
+	return fsys.Stat(path)
+}
+
+func getOrCreateDir(fsys FS, path string) (fs.FileInfo, error) {
+	f, err := fsys.Stat(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fsys.Mkdir(path, os.ModePerm)
 			if err != nil {
 				return nil, err
 			}
-			return os.Stat(newDir)
+			return fsys.Stat(path)
 		}
 		return f, err
 	}
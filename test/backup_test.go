@@ -0,0 +1,348 @@
+package test_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+// replayChanges - the records a collection directory should hold according to its change log
+func replayChanges(t *testing.T, dir string) map[string]string {
+	data, err := os.ReadFile(filepath.Join(dir, simplejsondb.ChangeLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var e simplejsondb.ChangeEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Op == simplejsondb.OpDelete {
+			delete(records, e.Key)
+		} else {
+			records[e.Key] = string(e.Value)
+		}
+	}
+	return records
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	path, snap := randName(6), randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer os.RemoveAll(snap)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// writers go on while the snapshot is taken
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key%d", (w*7+i)%20)
+				if i%5 == 4 {
+					c.Delete(key)
+				} else {
+					c.Create(key, []byte(fmt.Sprintf(`{"w": %d, "i": %d}`, w, i)), simplejsondb.Options{UseGzip: i%2 == 0})
+				}
+			}
+		}(w)
+	}
+	for c.Len() < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	err = db.Snapshot(snap)
+	close(stop)
+	wg.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Snapshot(snap); !errors.Is(err, os.ErrExist) {
+		t.Errorf("expected an existing snapshot to be kept, got %v", err)
+	}
+	if err := simplejsondb.VerifySnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records of the copy are exactly those its change log leads to
+	want := replayChanges(t, filepath.Join(snap, "collection1"))
+	copied, err := simplejsondb.New(snap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	cc, err := copied.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for key := range want {
+		data, err := cc.Get(key)
+		if err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		got[key] = string(data)
+	}
+	if len(got) != len(want) || int(cc.Len()) != len(want) {
+		t.Errorf("expected %d records, got %d (%d files)", len(want), len(got), cc.Len())
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s: expected %s, got %s", key, value, got[key])
+		}
+	}
+	if report, err := copied.Check(simplejsondb.CheckOptions{}); err != nil || len(report.Issues) != 0 {
+		t.Errorf("unexpected issues %v %v", report, err)
+	}
+
+	// a changed file no longer matches the manifest
+	if err := os.WriteFile(filepath.Join(snap, simplejsondb.MetaFile), []byte(`{}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := simplejsondb.VerifySnapshot(snap); !errors.Is(err, simplejsondb.ErrChecksum) {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+}
+
+func TestDB_SnapshotOplog(t *testing.T) {
+	path, snap := randName(6), randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer os.RemoveAll(snap)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(`{"a": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a directory left over by someone else is none of the snapshot's business
+	leftover := snap + ".tmp"
+	if err := os.MkdirAll(leftover, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(leftover)
+	if err := db.Snapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); err != nil {
+		t.Errorf("expected %s to stay, got %v", leftover, err)
+	}
+	if temps, _ := filepath.Glob("." + snap + ".tmp-*"); len(temps) != 0 {
+		t.Errorf("expected no temporary directory left, got %v", temps)
+	}
+
+	// the log of the copy ends with its records
+	copied, err := simplejsondb.New(snap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	var seqs []uint64
+	err = copied.ReadOplog(0, func(e simplejsondb.OplogEntry) error {
+		seqs = append(seqs, e.Seq)
+		return nil
+	})
+	if err != nil || len(seqs) != 5 {
+		t.Errorf("expected the 5 logged writes in the snapshot, got %v %v", seqs, err)
+	}
+}
+
+func TestDB_BackupRestore(t *testing.T) {
+	path, restored := randName(6), randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer os.RemoveAll(restored)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	files, err := db.Collection("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, err := db.Collection("segments", simplejsondb.Options{
+		Engine:  simplejsondb.EngineSegment,
+		Segment: &simplejsondb.SegmentOptions{MergeInterval: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		value := []byte(fmt.Sprintf(`{"i": %d}`, i))
+		if err := files.Create(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+		if err := segments.Create(fmt.Sprintf("key%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := simplejsondb.Restore(bytes.NewReader(archive.Bytes()), restored); err != nil {
+		t.Fatal(err)
+	}
+	copied, err := simplejsondb.New(restored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+	for _, name := range []string{"files", "segments"} {
+		c, err := copied.Collection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 10; i++ {
+			if data, err := c.Get(fmt.Sprintf("key%d", i)); err != nil || string(data) != fmt.Sprintf(`{"i": %d}`, i) {
+				t.Errorf("%s: unexpected record %q %v", name, data, err)
+			}
+		}
+	}
+
+	// a damaged archive is not restored
+	broken := randName(6)
+	defer os.RemoveAll(broken)
+	damaged := append([]byte{}, archive.Bytes()...)
+	damaged[len(damaged)/2] ^= 0xff
+	if err := simplejsondb.Restore(bytes.NewReader(damaged), broken); err == nil {
+		t.Error("expected a damaged archive to be refused")
+	}
+	if _, err := os.Stat(broken); !os.IsNotExist(err) {
+		t.Errorf("expected nothing restored, got %v", err)
+	}
+}
+
+func TestDB_BackupMemory(t *testing.T) {
+	restored := randName(6)
+	defer os.RemoveAll(restored)
+
+	db, err := simplejsondb.NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := simplejsondb.Restore(&archive, restored); err != nil {
+		t.Fatal(err)
+	}
+	if err := simplejsondb.VerifySnapshot(restored); err != nil {
+		t.Error(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(restored, "collection1", "key1"+simplejsondb.Ext)); err != nil || !bytes.HasSuffix(data, []byte(`{"a": 1}`)) {
+		t.Errorf("unexpected record file %q %v", data, err)
+	}
+}
+
+// snapshots and SaveTo hold the writes of several collections without deadlocking
+func TestDB_SnapshotSaveTo(t *testing.T) {
+	path, saved := randName(6), randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer os.RemoveAll(saved)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 4; i++ {
+		c, err := db.Collection(fmt.Sprintf("collection%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				if err := db.SaveTo(saved); err != nil {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				snap := randName(6)
+				defer os.RemoveAll(snap)
+				if err := db.Snapshot(snap); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+		t.Fatal("SaveTo and Snapshot deadlocked")
+	}
+}
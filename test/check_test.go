@@ -0,0 +1,226 @@
+package test_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func issueKinds(report *simplejsondb.CheckReport) map[string]int {
+	kinds := make(map[string]int)
+	for _, i := range report.Issues {
+		if !i.Repaired {
+			kinds[i.Kind]++
+		}
+	}
+	return kinds
+}
+
+func TestDB_Check(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key2", []byte(`{"b": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(path, "collection1")
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("key3"+simplejsondb.Ext, `{"c": `)
+	// a record whose checksum no longer matches
+	if err := c.Create("key4", []byte(`{"d": 4}`), simplejsondb.Options{UseGzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(filepath.Join(dir, "key4"+simplejsondb.GZipExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 0xff
+	write("key4"+simplejsondb.GZipExt, string(raw))
+	// and one written by another tool, which can not be read but may well be intact
+	write("key6"+simplejsondb.GZipExt, `not gzip`)
+	write(".key5"+simplejsondb.Ext+".tmp", `{}`)
+	if err := os.WriteFile(filepath.Join(path, simplejsondb.MetaFile+".tmp"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "misc"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	// a directory next to the collections which is none
+	if err := os.Mkdir(filepath.Join(path, "notes"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "notes", "todo.txt"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	// a gzip copy of key2 next to the file in the collection format, which wins however new
+	gz, err := simplejsondb.Gzip([]byte(`{"b": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write("key2"+simplejsondb.GZipExt, string(gz))
+
+	report, err := db.Check(simplejsondb.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		simplejsondb.IssueInvalidJSON: 1,
+		simplejsondb.IssueCorrupt:     1,
+		simplejsondb.IssueUnreadable:  1,
+		simplejsondb.IssueTempFile:    2,
+		simplejsondb.IssueStrayDir:    2,
+		simplejsondb.IssueDuplicate:   1,
+	}
+	if got := issueKinds(report); len(got) != len(want) {
+		t.Errorf("expected %v, got %v", want, report.Issues)
+	} else {
+		for kind, n := range want {
+			if got[kind] != n {
+				t.Errorf("expected %d %s issues, got %v", n, kind, report.Issues)
+			}
+		}
+	}
+	if report.OK() || report.Collections != 1 || report.Records != 6 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	for _, i := range report.Issues {
+		if i.Kind == simplejsondb.IssueDuplicate && i.Path != filepath.Join("collection1", "key2"+simplejsondb.GZipExt) {
+			t.Errorf("expected the gzip variant to be the duplicate, got %s", i)
+		}
+	}
+
+	report, err = db.Check(simplejsondb.CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := issueKinds(report); len(got) != 2 || got[simplejsondb.IssueStrayDir] != 2 || got[simplejsondb.IssueUnreadable] != 1 {
+		t.Errorf("expected only the stray directories and the unreadable record left, got %v", report.Issues)
+	}
+	if _, err := os.Stat(filepath.Join(path, "notes", simplejsondb.MetaFile)); !os.IsNotExist(err) {
+		t.Errorf("a stray directory should not become a collection, got %v", err)
+	}
+	if data, err := c.Get("key2"); err != nil || string(data) != `{"b": 2}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	for _, name := range []string{"key3" + simplejsondb.Ext, "key4" + simplejsondb.GZipExt} {
+		if _, err := os.Stat(filepath.Join(dir, simplejsondb.QuarantineDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "key6"+simplejsondb.GZipExt)); err != nil {
+		t.Errorf("a record failing no checksum should stay, got %v", err)
+	}
+
+	report, err = db.Check(simplejsondb.CheckOptions{Collections: []string{"collection1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 2 || report.Records != 3 {
+		t.Errorf("unexpected report after repair %+v", report)
+	}
+	if _, err := db.Check(simplejsondb.CheckOptions{Collections: []string{"missing"}}); !os.IsNotExist(err) {
+		t.Errorf("expected a missing collection to be reported, got %v", err)
+	}
+}
+
+func TestDB_CheckSegments(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	opts := &simplejsondb.Options{
+		Engine:  simplejsondb.EngineSegment,
+		Segment: &simplejsondb.SegmentOptions{MergeInterval: -1},
+	}
+	db, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key2", []byte(`{"b": `)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// reopening seals the segment, which gets its hint file
+	db, err = simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("collection1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	hints, err := filepath.Glob(filepath.Join(path, "collection1", simplejsondb.SegmentDir, "*"+simplejsondb.HintExt))
+	if err != nil || len(hints) == 0 {
+		t.Fatalf("expected a hint file, got %v %v", hints, err)
+	}
+	data, err := os.ReadFile(hints[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[8] ^= 0xff // the sequence number of the first entry
+	if err := os.WriteFile(hints[0], data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	report, err := db.Check(simplejsondb.CheckOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make(map[string]int)
+	for _, i := range report.Issues {
+		kinds[i.Kind]++
+		if i.Kind == simplejsondb.IssueIndex && !i.Repaired {
+			t.Errorf("expected the hint file to be rebuilt, got %s", i)
+		}
+	}
+	if kinds[simplejsondb.IssueIndex] != 1 || kinds[simplejsondb.IssueInvalidJSON] != 1 || report.Records != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	report, err = db.Check(simplejsondb.CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 1 || report.Issues[0].Kind != simplejsondb.IssueInvalidJSON {
+		t.Errorf("expected only the invalid entry left, got %v", report.Issues)
+	}
+}
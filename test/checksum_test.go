@@ -0,0 +1,133 @@
+package test_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestChecksum_Get(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": "aaaaaaaaaaaaaaaa"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key2", []byte(`{"b": 2}`), simplejsondb.Options{UseGzip: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated plain record
+	file := filepath.Join(path, "collection1", "key1"+simplejsondb.Ext)
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(file, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	// a flipped byte in a compressed one
+	gz := filepath.Join(path, "collection1", "key2"+simplejsondb.GZipExt)
+	data, err := os.ReadFile(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-5] ^= 0xff
+	if err := os.WriteFile(gz, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	// a read-only database reports the damage but moves nothing
+	ro, err := simplejsondb.New(path, &simplejsondb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := ro.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.Get("key1"); !errors.Is(err, simplejsondb.ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt, got %v", err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("a read-only database should leave the file, got %v", err)
+	}
+
+	for _, key := range []string{"key1", "key2"} {
+		_, err := c.Get(key)
+		if !errors.Is(err, simplejsondb.ErrCorrupt) || !errors.Is(err, simplejsondb.ErrChecksum) {
+			t.Errorf("expected ErrCorrupt, got %v", err)
+		}
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("expected the key in %v", err)
+		}
+		if _, err := c.Get(key); !os.IsNotExist(err) {
+			t.Errorf("expected a quarantined record to be gone, got %v", err)
+		}
+	}
+	for _, name := range []string{"key1" + simplejsondb.Ext, "key2" + simplejsondb.GZipExt} {
+		if _, err := os.Stat(filepath.Join(path, "collection1", simplejsondb.QuarantineDir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected no records, got %d", c.Len())
+	}
+}
+
+func TestChecksum_GetAll(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	// written by another tool: no checksum, and not gzip either
+	broken := filepath.Join(path, "collection1", "key2"+simplejsondb.GZipExt)
+	if err := os.WriteFile(broken, []byte(`{"not": "gzip"}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	records := c.GetAll()
+	if len(records) != 1 || string(records[0]) != `{"a": 1}` {
+		t.Errorf("expected only the intact record, got %q", records)
+	}
+	// without a checksum failing the file may be fine for another reader, so it stays
+	if _, err := os.Stat(broken); err != nil {
+		t.Errorf("expected the unreadable file to stay, got %v", err)
+	}
+	if _, err := c.Get("key2"); err == nil || errors.Is(err, simplejsondb.ErrCorrupt) {
+		t.Errorf("expected a read error other than ErrCorrupt, got %v", err)
+	}
+	if _, ok := c.GetAllByName()["key2"]; ok {
+		t.Error("an unreadable record should not be listed")
+	}
+}
@@ -0,0 +1,331 @@
+package test_test
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestCompression_Codecs(t *testing.T) {
+	for compression, ext := range map[string]string{
+		simplejsondb.CompressionNone:   simplejsondb.Ext,
+		simplejsondb.CompressionGzip:   simplejsondb.GZipExt,
+		simplejsondb.CompressionZstd:   simplejsondb.ZstdExt,
+		simplejsondb.CompressionSnappy: simplejsondb.SnappyExt,
+	} {
+		t.Run(compression, func(t *testing.T) {
+			path := randName(6)
+			defer func(dir ...string) {
+				if err := remove(dir...); err != nil {
+					t.Error(err)
+				}
+			}(path)
+
+			db, err := simplejsondb.New(path, &simplejsondb.Options{Compression: compression, CompressionLevel: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := db.Collection("collection1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Create("key1", []byte(`{"a": "aaaaaaaaaaaaaaaa"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(path, "collection1", "key1"+ext)); err != nil {
+				t.Error(err)
+			}
+			if data, err := c.Get("key1"); err != nil || string(data) != `{"a": "aaaaaaaaaaaaaaaa"}` {
+				t.Errorf("unexpected record %q %v", data, err)
+			}
+			if c.Meta().Compression != compression {
+				t.Errorf("unexpected metadata %+v", c.Meta())
+			}
+		})
+	}
+}
+
+func TestCompression_Mixed(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionSnappy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte("snappy")); err != nil {
+		t.Fatal(err)
+	}
+	// records written with another codec earlier are read as well
+	gz, err := simplejsondb.Gzip([]byte("gzip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "collection1", "key2"+simplejsondb.GZipExt), gz, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(path, "collection1", "key3"+simplejsondb.Ext), []byte("plain"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"key1": "snappy", "key2": "gzip", "key3": "plain"} {
+		if data, err := c.Get(key); err != nil || string(data) != want {
+			t.Errorf("%s: unexpected record %q %v", key, data, err)
+		}
+	}
+	if c.Len() != 3 || len(c.GetAll()) != 3 {
+		t.Errorf("expected 3 records, got %d", c.Len())
+	}
+
+	if _, err := simplejsondb.New(randName(6), &simplejsondb.Options{Compression: "lz4"}); !errors.Is(err, simplejsondb.ErrUnknownCompression) {
+		t.Errorf("expected ErrUnknownCompression, got %v", err)
+	}
+}
+
+func TestCompression_ZstdDictionary(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, []byte(fmt.Sprintf(`{"id": %d, "name": "user-%d", "active": %t, "role": "member"}`, i, i*7, i%2 == 0)))
+	}
+	dict, err := simplejsondb.TrainZstdDictionary(samples, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &simplejsondb.Options{Compression: simplejsondb.CompressionZstd, ZstdDictionary: dict}
+	db, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []byte(`{"id": 9001, "name": "user-63007", "active": false, "role": "member"}`)
+	if err := c.Create("u1", record); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(path, "users", "u1"+simplejsondb.ZstdExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// record files carry a checksum header, so compare with zstd alone
+	mem := simplejsondb.NewMemFS()
+	plain, err := simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionZstd, FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := plain.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pc.Create("u1", record); err != nil {
+		t.Fatal(err)
+	}
+	plainInfo, err := mem.Stat(filepath.Join(path, "users", "u1"+simplejsondb.ZstdExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() >= plainInfo.Size() {
+		t.Errorf("dictionary compression should shrink the record, got %d bytes, %d without", info.Size(), plainInfo.Size())
+	}
+
+	db2, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c2.Get("u1"); err != nil || string(data) != string(record) {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if m := c2.Meta(); m.ZstdDict == 0 || m.ZstdDict != db2.Meta().ZstdDict {
+		t.Errorf("metadata should name the dictionary, got %+v and %+v", m, db2.Meta())
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records cannot be read without the dictionary, or with another one
+	if _, err := simplejsondb.New(path, nil); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions without the dictionary, got %v", err)
+	}
+	other, err := simplejsondb.TrainZstdDictionary(samples[100:], 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionZstd, ZstdDictionary: other, ReadOnly: true}); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions with another dictionary, got %v", err)
+	}
+}
+
+func TestCompression_MinSize(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true, CompressMinSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(path, "collection1")
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+	large := []byte(fmt.Sprintf(`{"text": "%0500d"}`, 0))
+	if err := c.Create("small", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("large", large); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("small"+simplejsondb.Ext) || !exists("large"+simplejsondb.GZipExt) {
+		t.Error("only the payload above the threshold should be compressed")
+	}
+
+	// incompressible data above the threshold stays plain
+	noise := make([]byte, 300)
+	if _, err := rand.Read(noise); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("noise", noise); err != nil {
+		t.Fatal(err)
+	}
+	if !exists("noise" + simplejsondb.Ext) {
+		t.Error("compression which saves nothing should not be kept")
+	}
+
+	// a record changing form leaves no stale variant behind
+	if err := c.Create("large", []byte(`{"a": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if exists("large"+simplejsondb.GZipExt) || !exists("large"+simplejsondb.Ext) {
+		t.Error("the gzip variant should be replaced by the plain one")
+	}
+	if data, err := c.Get("large"); err != nil || string(data) != `{"a": 2}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if c.Len() != 3 {
+		t.Errorf("expected 3 records, got %d", c.Len())
+	}
+}
+
+func TestCompression_PerWrite(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(path, "collection1")
+	variants := func(key string) (found []string) {
+		for _, ext := range []string{simplejsondb.Ext, simplejsondb.GZipExt, simplejsondb.ZstdExt, simplejsondb.SnappyExt} {
+			if _, err := os.Stat(filepath.Join(dir, key+ext)); err == nil {
+				found = append(found, ext)
+			}
+		}
+		return
+	}
+
+	// a per-call UseGzip names the file after what is written
+	if err := c.Create("key1", []byte("v1"), simplejsondb.Options{UseGzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	if v := variants("key1"); len(v) != 1 || v[0] != simplejsondb.GZipExt {
+		t.Errorf("expected only the gzip variant, got %v", v)
+	}
+	if data, err := c.Get("key1"); err != nil || string(data) != "v1" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+
+	// switching forms replaces the old variant within the same write
+	steps := []struct {
+		opts simplejsondb.Options
+		ext  string
+	}{
+		{simplejsondb.Options{}, simplejsondb.Ext},
+		{simplejsondb.Options{Compression: simplejsondb.CompressionZstd}, simplejsondb.ZstdExt},
+		{simplejsondb.Options{Compression: simplejsondb.CompressionSnappy, UseGzip: true}, simplejsondb.SnappyExt},
+		{simplejsondb.Options{CompressMinSize: 1 << 10, UseGzip: true}, simplejsondb.Ext},
+	}
+	for i, step := range steps {
+		value := fmt.Sprintf("v%d", i+2)
+		if err := c.Create("key1", []byte(value), step.opts); err != nil {
+			t.Fatal(err)
+		}
+		if v := variants("key1"); len(v) != 1 || v[0] != step.ext {
+			t.Errorf("step %d: expected only %s, got %v", i, step.ext, v)
+		}
+		if data, err := c.Get("key1"); err != nil || string(data) != value {
+			t.Errorf("step %d: unexpected record %q %v", i, data, err)
+		}
+	}
+	if c.Len() != 1 {
+		t.Errorf("expected 1 record, got %d", c.Len())
+	}
+
+	// of variants left behind by something else, the file in the collection format wins
+	if err := c.Create("key2", []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := simplejsondb.Gzip([]byte("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "key2"+simplejsondb.GZipExt), gz, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get("key2"); err != nil || string(data) != "old" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	// the others are only looked for without it
+	if err := os.Remove(filepath.Join(dir, "key2"+simplejsondb.Ext)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get("key2"); err != nil || string(data) != "new" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if err := c.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	if v := variants("key2"); len(v) != 0 {
+		t.Errorf("delete should remove every variant, got %v", v)
+	}
+}
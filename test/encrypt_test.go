@@ -0,0 +1,283 @@
+package test_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryption_AtRest(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	key := newKey(t)
+	keys, err := simplejsondb.NewStaticKeys("k1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionGzip, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1", simplejsondb.Options{Encryption: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"ssn": "078-05-1120"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get("key1"); err != nil || string(data) != `{"ssn": "078-05-1120"}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if m := c.Meta(); m.Encryption != simplejsondb.EncryptionAESGCM || !m.Sealed {
+		t.Errorf("unexpected metadata %+v", m)
+	}
+	// a plain record planted in a collection encrypted from the start is refused
+	if err := os.WriteFile(filepath.Join(path, "collection1", "planted"+simplejsondb.Ext), []byte(`{"ssn": "x"}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("planted"); !errors.Is(err, simplejsondb.ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+	if err := os.Remove(filepath.Join(path, "collection1", "planted"+simplejsondb.Ext)); err != nil {
+		t.Fatal(err)
+	}
+	// compressed first, then sealed
+	raw, err := os.ReadFile(filepath.Join(path, "collection1", "key1"+simplejsondb.GZipExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(raw, []byte("078-05-1120")) || bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		t.Errorf("record stored in the clear %q", raw)
+	}
+	changes, err := os.ReadFile(filepath.Join(path, "collection1", simplejsondb.ChangeLogFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(changes, []byte("078-05")) || bytes.Contains(changes, []byte(base64.StdEncoding.EncodeToString([]byte(`{"ssn": "078-05-1120"}`)))) {
+		t.Errorf("change log holds the value in the clear %q", changes)
+	}
+	if _, err := db.Collection("collection1", simplejsondb.Options{Encryption: &simplejsondb.StaticKeys{}}); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+	}
+	db.Close()
+
+	// without the key nothing is read nor written in the clear
+	db, err = simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("key1"); !errors.Is(err, simplejsondb.ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+	if err := c.Create("key2", []byte(`{}`)); !errors.Is(err, simplejsondb.ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+	db.Close()
+
+	// another key under the same ID does not open the record
+	other, err := simplejsondb.NewStaticKeys("k1", newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionGzip, Encryption: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err = db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("key1"); !errors.Is(err, simplejsondb.ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestEncryption_RotateKey(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	// records written before the collection was encrypted
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"i": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	k1, k2 := newKey(t), newKey(t)
+	keys, err := simplejsondb.NewStaticKeys("k1", k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = simplejsondb.New(path, &simplejsondb.Options{Encryption: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the older records are read as they are until RotateKey has sealed them
+	if m := c.Meta(); m.Encryption != simplejsondb.EncryptionAESGCM || m.Sealed {
+		t.Errorf("unexpected metadata %+v", m)
+	}
+	if data, err := c.Get("key1"); err != nil || string(data) != `{"i": 1}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	var last simplejsondb.MigrateProgress
+	report := func(p simplejsondb.MigrateProgress) { last = p }
+	if err := c.RotateKey(report); err != nil {
+		t.Fatal(err)
+	}
+	if last.Total != 10 || last.Rewritten != 10 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	if !c.Meta().Sealed {
+		t.Errorf("RotateKey should record that every record is sealed, got %+v", c.Meta())
+	}
+	if err := os.WriteFile(filepath.Join(path, "collection1", "planted"+simplejsondb.Ext), []byte(`{}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get("planted"); !errors.Is(err, simplejsondb.ErrDecrypt) {
+		t.Errorf("expected ErrDecrypt, got %v", err)
+	}
+	if err := os.Remove(filepath.Join(path, "collection1", "planted"+simplejsondb.Ext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RotateKey(report); err != nil {
+		t.Fatal(err)
+	}
+	if last.Rewritten != 0 || last.Skipped != 10 {
+		t.Errorf("expected every record sealed already, got %+v", last)
+	}
+	if err := keys.Rotate("k2", k2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RotateKey(report); err != nil {
+		t.Fatal(err)
+	}
+	if last.Rewritten != 10 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	db.Close()
+
+	// the retired key is no longer needed
+	only2, err := simplejsondb.NewStaticKeys("k2", k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = simplejsondb.New(path, &simplejsondb.Options{Encryption: only2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err = db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if data, err := c.Get(fmt.Sprintf("key%d", i)); err != nil || string(data) != fmt.Sprintf(`{"i": %d}`, i) {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+	}
+	if n := len(c.GetAll()); n != 10 {
+		t.Errorf("expected 10 records, got %d", n)
+	}
+}
+
+func TestEncryption_KeyFile(t *testing.T) {
+	path := randName(6)
+	keyPath := path + ".keys"
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer os.Remove(keyPath)
+
+	line := func(id string) string {
+		return id + " " + base64.StdEncoding.EncodeToString(newKey(t)) + "\n"
+	}
+	if err := os.WriteFile(keyPath, []byte("# local keys\n"+line("k1")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := simplejsondb.NewKeyFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Engine: simplejsondb.EngineSegment, Encryption: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(keyPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(line("k2"))
+	f.Close()
+	if err := keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _ := keys.CurrentKey(); id != "k2" {
+		t.Errorf("expected the last key to be current, got %s", id)
+	}
+	if err := c.RotateKey(); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get("key1"); err != nil || string(data) != `{"a": 1}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+
+	if err := os.WriteFile(keyPath, []byte("k3 not-base64\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Reload(); err == nil {
+		t.Error("expected a malformed key file to be rejected")
+	}
+}
@@ -0,0 +1,236 @@
+//go:build unix
+
+package test_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+// two database handles on the same directory coordinate through OS file locks,
+// exactly as two processes would
+func TestLockID_InterProcess(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db1, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := db1.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := "rec"
+	lease, err := c1.LockID(id, simplejsondb.ModeWrite, simplejsondb.LockOptions{Scope: simplejsondb.ScopeInterProcess})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the holder itself may still write the record
+	if err := c1.Create(id, []byte(`{"v": 1}`), simplejsondb.Options{Lease: lease}); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		written <- c2.Create(id, []byte(`{"v": 2}`))
+	}()
+
+	select {
+	case <-written:
+		t.Fatalf("write from another handle should block while the record is locked")
+	case <-time.After(200 * time.Millisecond):
+		// expected blocked
+	}
+
+	if err := c1.UnlockID(id, lease.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("write did not proceed after the record was unlocked")
+	}
+
+	data, err := c1.Get(id)
+	if err != nil || string(data) != `{"v": 2}` {
+		t.Errorf("unexpected record %q, %v", data, err)
+	}
+
+	// process scoped locks do not reach other handles
+	lease, err = c1.LockID(id, simplejsondb.ModeWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Create(id, []byte(`{"v": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c1.UnlockID(id, lease.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	// record lock files only exist while held
+	for i := 0; i < 10; i++ {
+		if err := c2.Create(fmt.Sprintf("key%d", i), []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(path, "shared", simplejsondb.LockDir))
+	if err != nil || len(entries) != 0 {
+		t.Errorf("expected no lock files left, got %d %v", len(entries), err)
+	}
+}
+
+// a writer next in line gets its own exclusive OS lock, not the shared one of the reader before it
+func TestLockID_InterProcessHandOver(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db1, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := db1.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inter := simplejsondb.LockOptions{Scope: simplejsondb.ScopeInterProcess}
+	reader, err := c1.LockID("rec", simplejsondb.ModeRead, inter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := make(chan *simplejsondb.Lease, 1)
+	go func() {
+		lease, err := c1.LockID("rec", simplejsondb.ModeWrite, inter)
+		if err != nil {
+			t.Error(err)
+		}
+		leases <- lease
+	}()
+	for locks := c1.Locks(); len(locks) == 0 || locks[0].Waiters == 0; locks = c1.Locks() {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c1.UnlockID("rec", reader.Token); err != nil {
+		t.Fatal(err)
+	}
+	writer := <-leases
+	if writer == nil {
+		t.FailNow()
+	}
+	if _, err := c2.TryLockID("rec", simplejsondb.ModeRead, inter); !errors.Is(err, simplejsondb.ErrLockBusy) {
+		t.Errorf("expected the writer to exclude readers of other processes, got %v", err)
+	}
+	if err := c1.UnlockID("rec", writer.Token); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := c2.TryLockID("rec", simplejsondb.ModeWrite, inter)
+	if err != nil {
+		t.Fatalf("expected the record to be free, got %v", err)
+	}
+	c2.UnlockID("rec", lease.Token)
+}
+
+// a record held by another process only holds up the waiters of that record
+func TestLockID_InterProcessOtherRecords(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db1, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, err := db1.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inter := simplejsondb.LockOptions{Scope: simplejsondb.ScopeInterProcess}
+	other, err := c2.LockID("a", simplejsondb.ModeWrite, inter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leases := make(chan *simplejsondb.Lease, 1)
+	go func() {
+		lease, err := c1.LockID("a", simplejsondb.ModeWrite, inter)
+		if err != nil {
+			t.Error(err)
+		}
+		leases <- lease
+	}()
+	for len(c1.Locks()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond) // waiting for the OS lock of "a" by now
+
+	done := make(chan error, 1)
+	go func() {
+		lease, err := c1.LockID("b", simplejsondb.ModeWrite, simplejsondb.LockOptions{Scope: simplejsondb.ScopeInterProcess, Timeout: 200 * time.Millisecond})
+		if err == nil {
+			err = c1.UnlockID("b", lease.Token)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected record b to be free, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("record b waits for the OS lock of record a")
+	}
+
+	if err := c2.UnlockID("a", other.Token); err != nil {
+		t.Fatal(err)
+	}
+	if lease := <-leases; lease != nil {
+		c1.UnlockID("a", lease.Token)
+	}
+}
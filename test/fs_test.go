@@ -0,0 +1,171 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+// forEachFS - runs fn against a fresh database on the OS and on an in-memory file system
+func forEachFS(t *testing.T, fn func(t *testing.T, path string, fsys simplejsondb.FS)) {
+	t.Run("os", func(t *testing.T) {
+		path := randName(6)
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path)
+		fn(t, path, simplejsondb.OSFS{})
+	})
+	t.Run("memory", func(t *testing.T) {
+		fn(t, randName(6), simplejsondb.NewMemFS())
+	})
+}
+
+func TestFS_Records(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, UseGzip: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"key1", "key2", "key3"} {
+			if err := c.Create(k, []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get("key2"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("deleted record should be gone, got %v", err)
+		}
+		if data, err := c.Get("key3"); err != nil || string(data) != "key3" {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+		if all := c.GetAllByName(); c.Len() != 2 || len(c.GetAll()) != 2 || len(all) != 2 {
+			t.Errorf("unexpected records %q", all)
+		}
+		if _, err := fsys.Stat(filepath.Join(path, "collection1", "key1"+simplejsondb.GZipExt)); err != nil {
+			t.Error(err)
+		}
+
+		// the stored format is found again on the same file system
+		db2, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, ReadOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c2, err := db2.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c2.Meta().Compression != simplejsondb.CompressionGzip || c2.Len() != 2 {
+			t.Errorf("unexpected collection %+v with %d records", c2.Meta(), c2.Len())
+		}
+		if err := c2.Create("key4", nil); !errors.Is(err, simplejsondb.ErrReadOnly) {
+			t.Errorf("expected ErrReadOnly, got %v", err)
+		}
+	})
+}
+
+func TestFS_LayoutAndWatch(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, ExternalWatch: simplejsondb.WatchPoll, PollInterval: 10 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		c, err := db.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events, err := c.Watch(ctx, simplejsondb.WatchFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create("key1", []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Key != "key1" || e.Op != simplejsondb.OpCreate {
+			t.Errorf("unexpected event %+v", e)
+		}
+
+		if err := c.MigrateLayout(simplejsondb.LayoutSharded); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := c.Get("key1"); err != nil || string(data) != "v1" {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+		// an outside write is picked up by the polling watcher
+		if err := fsys.WriteFile(filepath.Join(path, "collection1", "key2"+simplejsondb.Ext), []byte("v2"), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Key != "key2" || string(e.Value) != "v2" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	})
+}
+
+func TestFS_Locks(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lease, err := c.LockID("key1", simplejsondb.ModeWrite, simplejsondb.LockOptions{Scope: simplejsondb.ScopeInterProcess})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.TryLockID("key1", simplejsondb.ModeRead); !errors.Is(err, simplejsondb.ErrLockBusy) {
+			t.Errorf("expected ErrLockBusy, got %v", err)
+		}
+		if err := c.Create("key1", []byte("v1"), simplejsondb.Options{Lease: lease}); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.UnlockID("key1", lease.Token); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMemFS_NotSupported(t *testing.T) {
+	fsys := simplejsondb.NewMemFS()
+	if _, err := simplejsondb.New("db", &simplejsondb.Options{FS: fsys, Engine: simplejsondb.EngineSegment}); !errors.Is(err, simplejsondb.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+	if _, err := simplejsondb.New("db", &simplejsondb.Options{FS: fsys, Oplog: &simplejsondb.OplogOptions{}}); !errors.Is(err, simplejsondb.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+	if err := fsys.Mkdir("a", 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.WriteFile("a/b", []byte("x"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove("a"); err == nil {
+		t.Error("removing a non-empty directory should fail")
+	}
+	if err := fsys.Rename("a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fsys.ReadFile("c/b"); err != nil || string(data) != "x" {
+		t.Errorf("unexpected file %q %v", data, err)
+	}
+	if err := fsys.WriteFile("missing/b", nil, 0o666); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected fs.ErrNotExist, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package test_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestCollection_ExternalWatch(t *testing.T) {
+	for _, mode := range []simplejsondb.ExternalWatch{simplejsondb.WatchAuto, simplejsondb.WatchPoll} {
+		path := randName(6)
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path)
+
+		db, err := simplejsondb.New(path, &simplejsondb.Options{ExternalWatch: mode, PollInterval: 50 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("watched")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := c.Watch(ctx, simplejsondb.WatchFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// writes through the library are reported once
+		if err := c.Create("own", []byte(`{"own": true}`)); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Key != "own" || e.Op != simplejsondb.OpCreate {
+			t.Errorf("unexpected event %+v", e)
+		}
+
+		// files edited by hand are picked up
+		file := filepath.Join(path, "watched", "manual.json")
+		if err := os.WriteFile(file, []byte(`{"manual": true}`), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Key != "manual" || e.Op != simplejsondb.OpCreate || string(e.Value) != `{"manual": true}` {
+			t.Errorf("unexpected event %+v", e)
+		}
+		if err := os.Remove(file); err != nil {
+			t.Fatal(err)
+		}
+		if e := next(t, events); e.Key != "manual" || e.Op != simplejsondb.OpDelete {
+			t.Errorf("unexpected event %+v", e)
+		}
+
+		select {
+		case e := <-events:
+			t.Errorf("unexpected extra event %+v", e)
+		case <-time.After(200 * time.Millisecond):
+		}
+		cancel()
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// closing the database while writes go on stops the watcher without a data race
+func TestCollection_ExternalWatchClose(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{ExternalWatch: simplejsondb.WatchPoll, PollInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("watched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			c.Create(fmt.Sprintf("key%d", i%10), []byte(`{}`))
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if err := db.Close(); err != nil {
+		t.Error(err)
+	}
+	<-done
+}
+
+// a record written by the library and then edited by hand is an update, not corruption,
+// whether a read or the watcher comes across it first
+func TestCollection_ExternalWatchHandEdit(t *testing.T) {
+	for _, interval := range []time.Duration{time.Hour, 20 * time.Millisecond} {
+		path := randName(6)
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path)
+
+		db, err := simplejsondb.New(path, &simplejsondb.Options{ExternalWatch: simplejsondb.WatchPoll, PollInterval: interval})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("watched")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		events, err := c.Watch(ctx, simplejsondb.WatchFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Create("k", []byte(`{"a": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+		next(t, events)
+
+		file := filepath.Join(path, "watched", "k"+simplejsondb.Ext)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		edited := bytes.TrimSuffix(data, []byte("}"))
+		edited = append(edited, []byte(`, "b": 2}`)...)
+		if err := os.WriteFile(file, edited, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		want := `{"a": 1, "b": 2}`
+		if interval != time.Hour {
+			if e := next(t, events); e.Key != "k" || e.Op != simplejsondb.OpCreate || string(e.Value) != want {
+				t.Errorf("unexpected event %+v", e)
+			}
+		}
+		if value, err := c.Get("k"); err != nil || string(value) != want {
+			t.Errorf("expected the edit to be read, got %q %v", value, err)
+		}
+		if interval == time.Hour {
+			if e := next(t, events); e.Key != "k" || e.Op != simplejsondb.OpCreate || string(e.Value) != want {
+				t.Errorf("unexpected event %+v", e)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(path, "watched", simplejsondb.QuarantineDir)); !os.IsNotExist(err) {
+			t.Errorf("expected nothing quarantined, got %v", err)
+		}
+		// the file is sealed again, so another database reads it as well
+		other, err := simplejsondb.New(path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		oc, err := other.Collection("watched")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, err := oc.Get("k"); err != nil || string(value) != want {
+			t.Errorf("expected the sealed edit, got %q %v", value, err)
+		}
+		other.Close()
+
+		select {
+		case e := <-events:
+			t.Errorf("unexpected extra event %+v", e)
+		case <-time.After(100 * time.Millisecond):
+		}
+		cancel()
+		if err := db.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
@@ -17,6 +17,7 @@ func randName(n int) string {
 	return string(b)
 }
 
+// remove - deletes a test path; directories may still hold metadata files
 func remove(dir ...string) error {
-	return os.Remove(filepath.Join(dir...))
+	return os.RemoveAll(filepath.Join(dir...))
 }
@@ -0,0 +1,142 @@
+package test_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestCollection_Hooks(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("hooked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var audit []string
+	errProtected := errors.New("protected record")
+	db.BeforeCreate(func(collection, key string, data []byte) ([]byte, error) {
+		return append(data[:len(data)-1:len(data)-1], []byte(`, "updatedAt": "now"}`)...), nil
+	})
+	c.BeforeCreate(func(collection, key string, data []byte) ([]byte, error) {
+		if key == "boom" {
+			panic("hook failure")
+		}
+		return data, nil
+	})
+	c.AfterCreate(func(collection, key string, data []byte) {
+		audit = append(audit, "create "+collection+"/"+key)
+	})
+	c.BeforeDelete(func(collection, key string, data []byte) ([]byte, error) {
+		if strings.HasPrefix(key, "keep") {
+			return nil, errProtected
+		}
+		return nil, nil
+	})
+	db.AfterDelete(func(collection, key string, data []byte) {
+		audit = append(audit, "delete "+collection+"/"+key)
+	})
+
+	// before hooks may change the data
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get("key1"); err != nil || string(data) != `{"a": 1, "updatedAt": "now"}` {
+		t.Errorf("unexpected record %q, %v", data, err)
+	}
+
+	// or veto the operation
+	if err := c.Create("keep1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("keep1"); !errors.Is(err, errProtected) {
+		t.Errorf("expected veto, got %v", err)
+	}
+	if _, err := c.Get("keep1"); err != nil {
+		t.Errorf("vetoed delete should keep the record: %v", err)
+	}
+
+	// a panicking hook fails the operation and leaves the collection usable
+	if err := c.Create("boom", []byte(`{}`)); !errors.Is(err, simplejsondb.ErrHookPanic) {
+		t.Errorf("expected ErrHookPanic, got %v", err)
+	}
+	if err := c.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "create hooked/key1,create hooked/keep1,delete hooked/key1"
+	if got := strings.Join(audit, ","); got != want {
+		t.Errorf("unexpected audit %q, want %q", got, want)
+	}
+}
+
+func TestCollection_HooksUnderRecordLock(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("hooked")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var errs []error
+	check := func(collection, key string) {
+		// the record is held, but no lease shows up for an operation
+		if lease, err := c.TryLockID(key, simplejsondb.ModeRead); !errors.Is(err, simplejsondb.ErrLockBusy) {
+			errs = append(errs, errors.New(key+": expected ErrLockBusy inside a hook"))
+			if err == nil {
+				c.UnlockID(key, lease.Token)
+			}
+		}
+		if locks := c.Locks(); len(locks) != 0 {
+			errs = append(errs, errors.New(key+": operation shows a lease"))
+		}
+		// other records stay usable
+		if _, err := c.Get("other"); err == nil {
+			errs = append(errs, errors.New(key+": unexpected record other"))
+		}
+	}
+	c.BeforeCreate(func(collection, key string, data []byte) ([]byte, error) {
+		check(collection, key)
+		return data, nil
+	})
+	c.AfterCreate(func(collection, key string, data []byte) { check(collection, key) })
+	c.BeforeDelete(func(collection, key string, data []byte) ([]byte, error) {
+		check(collection, key)
+		return nil, nil
+	})
+	c.AfterDelete(func(collection, key string, data []byte) { check(collection, key) })
+
+	if err := c.Create("key1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("key1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+	if _, err := c.TryLockID("key1", simplejsondb.ModeWrite); err != nil {
+		t.Errorf("record lock kept after the hooks: %v", err)
+	}
+}
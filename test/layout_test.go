@@ -0,0 +1,126 @@
+package test_test
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+// shardFiles - record files found two directory levels below dir
+func shardFiles(t *testing.T, fsys simplejsondb.FS, dir string) []string {
+	var files []string
+	var walk func(dir string, depth int)
+	walk = func(dir string, depth int) {
+		entries, err := fsys.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			name := filepath.Join(dir, e.Name())
+			switch {
+			case depth < 2 && e.IsDir() && len(e.Name()) == 2:
+				walk(name, depth+1)
+			case depth == 2 && !e.IsDir() && strings.HasSuffix(e.Name(), simplejsondb.Ext):
+				files = append(files, name)
+			}
+		}
+	}
+	walk(dir, 0)
+	return files
+}
+
+func TestLayout_Sharded(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, Layout: simplejsondb.LayoutSharded})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := c.Meta(); m.Layout != simplejsondb.LayoutSharded {
+			t.Errorf("collection should record the sharded layout, got %q", m.Layout)
+		}
+		keys := []string{"key1", "key2", "key3"}
+		for _, k := range keys {
+			if err := c.Create(k, []byte(`{"a": 1}`)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if files := shardFiles(t, fsys, filepath.Join(path, "collection1")); len(files) != len(keys) {
+			t.Errorf("expected %d sharded record files, got %v", len(keys), files)
+		}
+		if c.Len() != uint64(len(keys)) || len(c.GetAll()) != len(keys) || len(c.GetAllByName()) != len(keys) {
+			t.Errorf("sharded records should all be listed, got %d", c.Len())
+		}
+		if data, err := c.Get("key2"); err != nil || string(data) != `{"a": 1}` {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+		if err := c.Delete("key2"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Get("key2"); err == nil {
+			t.Error("deleted record should be gone")
+		}
+
+		// a layout which disagrees with the stored one is refused
+		if _, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, Layout: simplejsondb.LayoutFlat}); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+			t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+		}
+		if _, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys, Layout: "nested"}); !errors.Is(err, simplejsondb.ErrUnknownLayout) {
+			t.Errorf("expected ErrUnknownLayout, got %v", err)
+		}
+	})
+}
+
+func TestLayout_Migrate(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("collection1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"key1", "key2"} {
+			if err := c.Create(k, []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dir := filepath.Join(path, "collection1")
+
+		if err := c.MigrateLayout(simplejsondb.LayoutSharded); err != nil {
+			t.Fatal(err)
+		}
+		if files := shardFiles(t, fsys, dir); len(files) != 2 {
+			t.Errorf("records should be moved into shards, got %v", files)
+		}
+		if c.Meta().Layout != simplejsondb.LayoutSharded {
+			t.Errorf("metadata should follow the migration, got %q", c.Meta().Layout)
+		}
+		if data, err := c.Get("key1"); err != nil || string(data) != "key1" {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+
+		if err := c.MigrateLayout(simplejsondb.LayoutFlat); err != nil {
+			t.Fatal(err)
+		}
+		if files := shardFiles(t, fsys, dir); len(files) != 0 {
+			t.Errorf("records should be moved back, got %v", files)
+		}
+		if _, err := fsys.Stat(filepath.Join(dir, "key2"+simplejsondb.Ext)); err != nil {
+			t.Error(err)
+		}
+		if c.Len() != 2 {
+			t.Errorf("expected 2 records, got %d", c.Len())
+		}
+		if err := c.MigrateLayout("nested"); !errors.Is(err, simplejsondb.ErrUnknownLayout) {
+			t.Errorf("expected ErrUnknownLayout, got %v", err)
+		}
+	})
+}
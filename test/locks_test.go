@@ -1,6 +1,8 @@
 package test_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"testing"
@@ -10,354 +12,714 @@ import (
 )
 
 func TestCollection_LockID(t *testing.T) {
-	path := randName(6)
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
 			t.Error(err)
 		}
-	}(path)
 
-	db, err := simplejsondb.New(path, nil)
-	if err != nil {
-		t.Error(err)
-	}
+		table := "collection_lock_test"
+		c, err := db.Collection(table)
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path, table)
 
-	table := "collection_lock_test"
-	c, err := db.Collection(table)
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
+		if err != nil {
 			t.Error(err)
 		}
-	}(path, table)
-
-	if err != nil {
-		t.Error(err)
-	}
-
-	// Table-driven tests
-	tests := []struct {
-		name      string
-		id        string
-		lockMode  simplejsondb.LockMode
-		unlock    bool
-		expectErr bool
-		wait      bool
-	}{
-		{
-			name:      "LockID_Read_Mode_Success",
-			id:        "record1",
-			lockMode:  simplejsondb.ModeRead,
-			unlock:    true,
-			expectErr: false,
-			wait:      false,
-		},
-		{
-			name:      "LockID_Wait_Read_Mode_Success",
-			id:        "record1.1",
-			lockMode:  simplejsondb.ModeRead,
-			unlock:    true,
-			expectErr: false,
-			wait:      true,
-		},
-		{
-			name:      "LockID_Write_Mode_Success",
-			id:        "record2",
-			lockMode:  simplejsondb.ModeWrite,
-			unlock:    true,
-			expectErr: false,
-			wait:      false,
-		},
-		{
-			name:      "LockID_Write_Mode_Success",
-			id:        "record2",
-			lockMode:  simplejsondb.ModeReadWrite,
-			unlock:    true,
-			expectErr: false,
-			wait:      false,
-		},
-		{
-			name:      "LockID_Multiple_Reads_Same_ID",
-			id:        "record3",
-			lockMode:  simplejsondb.ModeRead,
-			unlock:    true,
-			expectErr: false,
-			wait:      false,
-		},
-		{
-			name:      "LockID_No_Unlock",
-			id:        "record4",
-			lockMode:  simplejsondb.ModeWrite,
-			unlock:    false,
-			expectErr: false,
-			wait:      false,
-		},
-		{
-			name:      "Unlock_Without_Lock",
-			id:        "nonexistent",
-			lockMode:  simplejsondb.NoMode,
-			unlock:    true,
-			expectErr: true,
-			wait:      false,
-		},
-		{
-			name:      "Double_Unlock_Error",
-			id:        "record5",
-			lockMode:  simplejsondb.ModeWrite,
-			unlock:    true,
-			expectErr: true,
-			wait:      false,
-		},
-	}
-
-	for _, tt := range tests {
-		f := func(t *testing.T) {
-			if c.IsLock(tt.id) {
-				// just logging in original test
-			} else {
-				// just logging
-			}
-			state := c.GetLock(tt.id)
-			if state != nil && (state.State.R > 0 || state.State.W > 0) {
-				if !tt.unlock {
-					return
-				}
-			}
 
-			if tt.name != "Unlock_Without_Lock" {
-				// Use LockID for valid lock operations
-				_, err = c.LockID(tt.id, tt.lockMode)
-				if err != nil {
-					// log only
+		// Table-driven tests
+		tests := []struct {
+			name      string
+			id        string
+			lockMode  simplejsondb.LockMode
+			unlock    bool
+			expectErr bool
+			wait      bool
+		}{
+			{
+				name:      "LockID_Read_Mode_Success",
+				id:        "record1",
+				lockMode:  simplejsondb.ModeRead,
+				unlock:    true,
+				expectErr: false,
+				wait:      false,
+			},
+			{
+				name:      "LockID_Wait_Read_Mode_Success",
+				id:        "record1.1",
+				lockMode:  simplejsondb.ModeRead,
+				unlock:    true,
+				expectErr: false,
+				wait:      true,
+			},
+			{
+				name:      "LockID_Write_Mode_Success",
+				id:        "record2",
+				lockMode:  simplejsondb.ModeWrite,
+				unlock:    true,
+				expectErr: false,
+				wait:      false,
+			},
+			{
+				name:      "LockID_Write_Mode_Success",
+				id:        "record2",
+				lockMode:  simplejsondb.ModeReadWrite,
+				unlock:    true,
+				expectErr: false,
+				wait:      false,
+			},
+			{
+				name:      "LockID_Multiple_Reads_Same_ID",
+				id:        "record3",
+				lockMode:  simplejsondb.ModeRead,
+				unlock:    true,
+				expectErr: false,
+				wait:      false,
+			},
+			{
+				name:      "LockID_No_Unlock",
+				id:        "record4",
+				lockMode:  simplejsondb.ModeWrite,
+				unlock:    false,
+				expectErr: false,
+				wait:      false,
+			},
+			{
+				name:      "Unlock_Without_Lock",
+				id:        "nonexistent",
+				lockMode:  simplejsondb.NoMode,
+				unlock:    true,
+				expectErr: true,
+				wait:      false,
+			},
+			{
+				name:      "Double_Unlock_Error",
+				id:        "record5",
+				lockMode:  simplejsondb.ModeWrite,
+				unlock:    true,
+				expectErr: true,
+				wait:      false,
+			},
+		}
+
+		for _, tt := range tests {
+			f := func(t *testing.T) {
+				if c.IsLock(tt.id) {
+					// just logging in original test
 				} else {
-					_ = fmt.Sprintf("%s", tt.id)
+					// just logging
 				}
-			}
-
-			state = c.GetLock(tt.id)
-			_ = state
-
-			if tt.unlock {
-				// Attempt to unlock the ID
-				err = c.UnlockID(tt.id)
-				if err != nil {
-					// expected in some cases
+				state := c.GetLock(tt.id)
+				if state != nil && (state.State.R > 0 || state.State.W > 0) {
+					if !tt.unlock {
+						return
+					}
 				}
-				// Second unlock to trigger error for specific case
-				if tt.name == "Double_Unlock_Error" {
-					err = c.UnlockID(tt.id)
-					_ = err
+
+				var lease *simplejsondb.Lease
+				token := ""
+				if tt.name != "Unlock_Without_Lock" {
+					// Use LockID for valid lock operations
+					lease, err = c.LockID(tt.id, tt.lockMode)
+					if lease != nil {
+						token = lease.Token
+					}
+					if err != nil {
+						// log only
+					} else {
+						_ = fmt.Sprintf("%s", tt.id)
+					}
 				}
-			}
 
-			if tt.wait {
 				state = c.GetLock(tt.id)
-				if state != nil && state.WG != nil {
-					state.WG.Wait()
+				_ = state
+
+				if tt.unlock {
+					// Attempt to unlock the ID
+					err = c.UnlockID(tt.id, token)
+					if err != nil && !tt.expectErr {
+						t.Errorf("unlock err: %v", err)
+					}
+					// Second unlock to trigger error for specific case
+					if tt.name == "Double_Unlock_Error" {
+						err = c.UnlockID(tt.id, token)
+						if !errors.Is(err, simplejsondb.ErrNotOwner) {
+							t.Errorf("expected ErrNotOwner on double unlock, got %v", err)
+						}
+					}
+				}
+
+				if tt.wait {
+					state = c.GetLock(tt.id)
+					if state != nil && state.WG != nil {
+						state.WG.Wait()
+					}
 				}
 			}
+			t.Run(tt.name, f)
 		}
-		t.Run(tt.name, f)
-	}
+	})
 }
 
 // Concurrency tests for LockID/UnlockID
 func TestLockID_ConcurrentReadersThenWriter(t *testing.T) {
-	path := randName(6)
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
 		}
-	}(path)
-
-	db, err := simplejsondb.New(path, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	c, err := db.Collection("locks")
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+		c, err := db.Collection("locks")
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path, "locks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := "rec"
+
+		// Acquire two read locks concurrently
+		var wg sync.WaitGroup
+		readers := make([]*simplejsondb.Lease, 2)
+		wg.Add(2)
+		for i := 0; i < 2; i++ {
+			go func(i int) {
+				defer wg.Done()
+				lease, err := c.LockID(id, simplejsondb.ModeRead)
+				if err != nil {
+					t.Errorf("reader lock err: %v", err)
+					return
+				}
+				readers[i] = lease
+			}(i)
 		}
-	}(path, "locks")
-	if err != nil {
-		t.Fatal(err)
-	}
-	id := "rec"
+		wg.Wait()
 
-	// Acquire two read locks concurrently
-	var wg sync.WaitGroup
-	wg.Add(2)
-	for i := 0; i < 2; i++ {
+		// Writer should block until readers release
+		writerAcquired := make(chan *simplejsondb.Lease, 1)
 		go func() {
-			defer wg.Done()
-			if _, err := c.LockID(id, simplejsondb.ModeRead); err != nil {
-				t.Errorf("reader lock err: %v", err)
+			lease, err := c.LockID(id, simplejsondb.ModeWrite)
+			if err != nil {
+				// notify anyway to avoid goroutine leak in test; but test will fail below
+				writerAcquired <- nil
 				return
 			}
+			writerAcquired <- lease
 		}()
-	}
-	wg.Wait()
-
-	// Writer should block until readers release
-	writerAcquired := make(chan struct{}, 1)
-	go func() {
-		if _, err := c.LockID(id, simplejsondb.ModeWrite); err != nil {
-			// notify anyway to avoid goroutine leak in test; but test will fail below
-			writerAcquired <- struct{}{}
-			return
-		}
-		writerAcquired <- struct{}{}
-	}()
-
-	select {
-	case <-writerAcquired:
-		// Should not acquire yet
-		t.Fatalf("writer should be blocked while readers hold the lock")
-	case <-time.After(200 * time.Millisecond):
-		// expected: still blocked
-	}
-
-	// Release both readers
-	if err := c.UnlockID(id); err != nil {
-		t.Fatalf("unlock reader 1: %v", err)
-	}
-	if err := c.UnlockID(id); err != nil {
-		t.Fatalf("unlock reader 2: %v", err)
-	}
-
-	// Now writer should acquire shortly
-	select {
-	case <-writerAcquired:
-		// acquired; release writer
-		if err := c.UnlockID(id); err != nil {
-			t.Fatalf("unlock writer: %v", err)
+
+		select {
+		case <-writerAcquired:
+			// Should not acquire yet
+			t.Fatalf("writer should be blocked while readers hold the lock")
+		case <-time.After(200 * time.Millisecond):
+			// expected: still blocked
+		}
+
+		// Release both readers
+		if err := c.UnlockID(id, readers[0].Token); err != nil {
+			t.Fatalf("unlock reader 1: %v", err)
+		}
+		if err := c.UnlockID(id, readers[1].Token); err != nil {
+			t.Fatalf("unlock reader 2: %v", err)
+		}
+
+		// Now writer should acquire shortly
+		select {
+		case writer := <-writerAcquired:
+			if writer == nil {
+				t.Fatalf("writer lock failed")
+			}
+			// acquired; release writer
+			if err := c.UnlockID(id, writer.Token); err != nil {
+				t.Fatalf("unlock writer: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("writer did not acquire after readers released")
 		}
-	case <-time.After(2 * time.Second):
-		t.Fatalf("writer did not acquire after readers released")
-	}
+	})
 }
 
 func TestLockID_WriterBlocksReaders(t *testing.T) {
-	path := randName(6)
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks2")
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path, "locks2")
+		if err != nil {
+			t.Fatal(err)
 		}
-	}(path)
+		id := "rec2"
 
-	db, err := simplejsondb.New(path, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	c, err := db.Collection("locks2")
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+		// Hold writer lock
+		writer, err := c.LockID(id, simplejsondb.ModeWrite)
+		if err != nil {
+			t.Fatalf("writer lock err: %v", err)
+		}
+
+		readerAcquired := make(chan *simplejsondb.Lease, 1)
+		go func() {
+			if lease, err := c.LockID(id, simplejsondb.ModeRead); err == nil {
+				readerAcquired <- lease
+			}
+		}()
+
+		select {
+		case <-readerAcquired:
+			t.Fatalf("reader should be blocked by writer lock")
+		case <-time.After(200 * time.Millisecond):
+			// expected blocked
 		}
-	}(path, "locks2")
-	if err != nil {
-		t.Fatal(err)
-	}
-	id := "rec2"
-
-	// Hold writer lock
-	if _, err := c.LockID(id, simplejsondb.ModeWrite); err != nil {
-		t.Fatalf("writer lock err: %v", err)
-	}
-
-	readerAcquired := make(chan struct{}, 1)
-	go func() {
-		if _, err := c.LockID(id, simplejsondb.ModeRead); err == nil {
-			readerAcquired <- struct{}{}
-		}
-	}()
-
-	select {
-	case <-readerAcquired:
-		t.Fatalf("reader should be blocked by writer lock")
-	case <-time.After(200 * time.Millisecond):
-		// expected blocked
-	}
-
-	// Release writer
-	if err := c.UnlockID(id); err != nil {
-		t.Fatalf("unlock writer: %v", err)
-	}
-
-	// Now reader should acquire soon
-	select {
-	case <-readerAcquired:
-		// ok; release reader
-		if err := c.UnlockID(id); err != nil {
-			t.Fatalf("unlock reader: %v", err)
-		}
-	case <-time.After(2 * time.Second):
-		t.Fatalf("reader did not acquire after writer released")
-	}
+
+		// Release writer
+		if err := c.UnlockID(id, writer.Token); err != nil {
+			t.Fatalf("unlock writer: %v", err)
+		}
+
+		// Now reader should acquire soon
+		select {
+		case reader := <-readerAcquired:
+			// ok; release reader
+			if err := c.UnlockID(id, reader.Token); err != nil {
+				t.Fatalf("unlock reader: %v", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("reader did not acquire after writer released")
+		}
+	})
 }
 
 func TestLockID_WaitGroupWaits(t *testing.T) {
-	path := randName(6)
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks3")
+		defer func(dir ...string) {
+			if err := remove(dir...); err != nil {
+				t.Error(err)
+			}
+		}(path, "locks3")
+		if err != nil {
+			t.Fatal(err)
 		}
-	}(path)
+		id := "rec3"
 
-	db, err := simplejsondb.New(path, nil)
-	if err != nil {
-		t.Fatal(err)
-	}
-	c, err := db.Collection("locks3")
-	defer func(dir ...string) {
-		if err := remove(dir...); err != nil {
-			t.Error(err)
+		// Acquire two reader locks
+		reader1, err := c.LockID(id, simplejsondb.ModeRead)
+		if err != nil {
+			t.Fatalf("reader1 lock err: %v", err)
+		}
+		reader2, err := c.LockID(id, simplejsondb.ModeRead)
+		if err != nil {
+			t.Fatalf("reader2 lock err: %v", err)
+		}
+
+		lock := c.GetLock(id)
+		if lock == nil || lock.WG == nil {
+			t.Fatalf("expected non-nil WaitGroup for id %s", id)
+		}
+
+		released := make(chan struct{}, 1)
+		go func(wg *sync.WaitGroup) {
+			wg.Wait()
+			released <- struct{}{}
+		}(lock.WG)
+
+		// Ensure Wait() is actually waiting
+		select {
+		case <-released:
+			t.Fatalf("WaitGroup finished before unlocks")
+		case <-time.After(200 * time.Millisecond):
+			// still waiting, as expected
+		}
+
+		// Unlock twice; after this WG should be done and cleaned eventually
+		if err := c.UnlockID(id, reader1.Token); err != nil {
+			t.Fatalf("unlock reader1: %v", err)
+		}
+		if err := c.UnlockID(id, reader2.Token); err != nil {
+			t.Fatalf("unlock reader2: %v", err)
+		}
+
+		select {
+		case <-released:
+			// OK
+		case <-time.After(2 * time.Second):
+			t.Fatalf("WaitGroup did not finish after all unlocks")
+		}
+	})
+}
+
+func TestLockID_TryAndContext(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := "rec4"
+
+		reader1, err := c.TryLockID(id, simplejsondb.ModeRead)
+		if err != nil {
+			t.Fatalf("try read lock err: %v", err)
+		}
+		// readers share, writers are refused right away
+		reader2, err := c.TryLockID(id, simplejsondb.ModeRead)
+		if err != nil {
+			t.Fatalf("second try read lock err: %v", err)
+		}
+		if _, err := c.TryLockID(id, simplejsondb.ModeWrite); !errors.Is(err, simplejsondb.ErrLockBusy) {
+			t.Fatalf("expected ErrLockBusy, got %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := c.LockIDContext(ctx, id, simplejsondb.ModeWrite); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if _, err := c.LockID(id, simplejsondb.ModeWrite, simplejsondb.LockOptions{Timeout: 50 * time.Millisecond}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+
+		// abandoned acquisitions leave the bookkeeping untouched
+		lock := c.GetLock(id)
+		if lock == nil || lock.State.R != 2 || lock.State.W != 0 || *lock.Mode != simplejsondb.ModeRead {
+			t.Fatalf("unexpected lock state %+v", lock)
+		}
+		if err := c.UnlockID(id, reader1.Token); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.UnlockID(id, reader2.Token); err != nil {
+			t.Fatal(err)
+		}
+		if c.IsLock(id) {
+			t.Fatalf("record should be unlocked")
+		}
+
+		// the write lock is available again once the readers are gone
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel2()
+		writer, err := c.LockIDContext(ctx2, id, simplejsondb.ModeWrite)
+		if err != nil {
+			t.Fatalf("write lock err: %v", err)
+		}
+		if err := c.UnlockID(id, writer.Token); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLockID_Leases(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks5")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := "rec5"
+
+		lease, err := c.LockID(id, simplejsondb.ModeWrite, simplejsondb.LockOptions{TTL: 150 * time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lease.Token == "" || lease.TTL != 150*time.Millisecond || lease.Expires.IsZero() {
+			t.Fatalf("unexpected lease %+v", lease)
+		}
+
+		// only the owner may unlock or renew
+		if err := c.UnlockID(id, "not-the-owner"); !errors.Is(err, simplejsondb.ErrNotOwner) {
+			t.Fatalf("expected ErrNotOwner, got %v", err)
+		}
+		if _, err := c.RenewID(id, "not-the-owner", 0); !errors.Is(err, simplejsondb.ErrNotOwner) {
+			t.Fatalf("expected ErrNotOwner, got %v", err)
+		}
+
+		// renewing keeps the lock past its original expiry
+		time.Sleep(100 * time.Millisecond)
+		renewed, err := c.RenewID(id, lease.Token, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !renewed.Expires.After(lease.Expires) {
+			t.Fatalf("renewal should extend the lease, %v <= %v", renewed.Expires, lease.Expires)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if !c.IsLock(id) {
+			t.Fatalf("renewed lease should still hold the lock")
+		}
+
+		// an abandoned lease is reclaimed and a waiting writer gets through
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		next, err := c.LockIDContext(ctx, id, simplejsondb.ModeWrite)
+		if err != nil {
+			t.Fatalf("lock after expiry err: %v", err)
+		}
+		if err := c.UnlockID(id, lease.Token); !errors.Is(err, simplejsondb.ErrNotOwner) {
+			t.Fatalf("expired token should no longer unlock, got %v", err)
+		}
+		if err := c.UnlockID(id, next.Token); err != nil {
+			t.Fatal(err)
+		}
+		if c.IsLock(id) {
+			t.Fatalf("record should be unlocked")
+		}
+
+		// without a TTL the lease is held until unlocked
+		held, err := c.LockID(id, simplejsondb.ModeWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if held.TTL != 0 || !held.Expires.IsZero() {
+			t.Fatalf("expected a lease without expiry, got %+v", held)
+		}
+		if _, err := c.TryLockID(id, simplejsondb.ModeRead); !errors.Is(err, simplejsondb.ErrLockBusy) {
+			t.Fatalf("expected the lease to hold the lock, got %v", err)
+		}
+		if err := c.UnlockID(id, held.Token); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLockID_Deadlock(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks6")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// locking the same record twice for writing can never succeed
+		opts0 := simplejsondb.LockOptions{Owner: "owner0"}
+		lease, err := c.LockID("a", simplejsondb.ModeWrite, opts0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.LockID("a", simplejsondb.ModeWrite, opts0); !errors.Is(err, simplejsondb.ErrDeadlock) {
+			t.Fatalf("expected ErrDeadlock on double lock, got %v", err)
+		}
+		if err := c.UnlockID("a", lease.Token); err != nil {
+			t.Fatal(err)
+		}
+
+		// owner 1 holds a and wants b while owner 2 holds b and wants a
+		opts1 := simplejsondb.LockOptions{Owner: "owner1"}
+		opts2 := simplejsondb.LockOptions{Owner: "owner2"}
+		a, err := c.LockID("a", simplejsondb.ModeWrite, opts1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := c.LockID("b", simplejsondb.ModeWrite, opts2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// a wait bounded by a timeout is part of the graph as well
+		waited := make(chan *simplejsondb.Lease, 1)
+		go func() {
+			bounded := opts1
+			bounded.Timeout = 5 * time.Second
+			lease, err := c.LockID("b", simplejsondb.ModeWrite, bounded)
+			if err != nil {
+				t.Errorf("owner1 lock err: %v", err)
+			}
+			waited <- lease
+		}()
+		time.Sleep(100 * time.Millisecond)
+
+		_, err = c.LockID("a", simplejsondb.ModeWrite, opts2)
+		var deadlock *simplejsondb.DeadlockError
+		if !errors.Is(err, simplejsondb.ErrDeadlock) || !errors.As(err, &deadlock) {
+			t.Fatalf("expected ErrDeadlock, got %v", err)
+		}
+		if len(deadlock.IDs) != 2 || deadlock.IDs[0] != "a" || deadlock.IDs[1] != "b" {
+			t.Errorf("unexpected IDs in cycle %v", deadlock.IDs)
+		}
+
+		// owner 2 backs off, owner 1 proceeds
+		if err := c.UnlockID("b", b.Token); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case lease := <-waited:
+			if lease != nil {
+				if err := c.UnlockID("b", lease.Token); err != nil {
+					t.Fatal(err)
+				}
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("owner1 did not acquire b")
+		}
+		if err := c.UnlockID("a", a.Token); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCollection_RecordLocking(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := "rec7"
+		if err := c.Create(id, []byte(`{"v": 0}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		lease, err := c.LockID(id, simplejsondb.ModeWrite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the holder writes through its lease
+		if err := c.Create(id, []byte(`{"v": 1}`), simplejsondb.Options{Lease: lease}); err != nil {
+			t.Fatal(err)
+		}
+
+		written := make(chan error, 1)
+		go func() {
+			written <- c.Create(id, []byte(`{"v": 2}`))
+		}()
+		read := make(chan []byte, 1)
+		go func() {
+			data, _ := c.Get(id)
+			read <- data
+		}()
+		// other records are not affected
+		if err := c.Create("other", []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-written:
+			t.Fatalf("writer should be blocked while the record is locked")
+		case <-read:
+			t.Fatalf("reader should be blocked while the record is write locked")
+		case <-time.After(200 * time.Millisecond):
+			// expected blocked
+		}
+		// record operations take the lock without a lease of their own
+		if locks := c.Locks(); len(locks) != 1 || len(locks[0].Owners) != 1 || locks[0].Owners[0] != lease.Owner {
+			t.Errorf("expected only the lease of the holder, got %+v", locks)
+		}
+
+		if err := c.UnlockID(id, lease.Token); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-written:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("writer did not proceed after unlock")
+		}
+		select {
+		case data := <-read:
+			if len(data) == 0 {
+				t.Errorf("reader got no data")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("reader did not proceed after unlock")
+		}
+
+		// a stale or read-only lease does not let writes through
+		if err := c.Delete(id, simplejsondb.Options{Lease: lease}); !errors.Is(err, simplejsondb.ErrNotOwner) {
+			t.Errorf("expected ErrNotOwner, got %v", err)
+		}
+		reader, err := c.LockID(id, simplejsondb.ModeRead)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete(id, simplejsondb.Options{Lease: reader}); !errors.Is(err, simplejsondb.ErrLeaseMode) {
+			t.Errorf("expected ErrLeaseMode, got %v", err)
+		}
+		if data, err := c.Get(id, simplejsondb.Options{Lease: reader}); err != nil || string(data) != `{"v": 2}` {
+			t.Errorf("unexpected read %q, %v", data, err)
+		}
+		if err := c.UnlockID(id, reader.Token); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Delete(id); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestLockIDs(t *testing.T) {
+	forEachFS(t, func(t *testing.T, path string, fsys simplejsondb.FS) {
+		db, err := simplejsondb.New(path, &simplejsondb.Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := db.Collection("locks8")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// opposite request orders never deadlock
+		var wg sync.WaitGroup
+		for _, ids := range [][]string{{"a", "b", "c"}, {"c", "b", "a"}, {"b", "c", "a", "b"}} {
+			wg.Add(1)
+			go func(ids []string) {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					m, err := c.LockIDs(ids, simplejsondb.ModeWrite)
+					if err != nil {
+						t.Errorf("lock %v err: %v", ids, err)
+						return
+					}
+					if len(m.Leases) != 3 || m.Lease("b") == nil {
+						t.Errorf("unexpected leases %+v", m.Leases)
+					}
+					if err := m.Unlock(); err != nil {
+						t.Errorf("unlock %v err: %v", ids, err)
+						return
+					}
+				}
+			}(ids)
 		}
-	}(path, "locks3")
-	if err != nil {
-		t.Fatal(err)
-	}
-	id := "rec3"
-
-	// Acquire two reader locks
-	if _, err := c.LockID(id, simplejsondb.ModeRead); err != nil {
-		t.Fatalf("reader1 lock err: %v", err)
-	}
-	if _, err := c.LockID(id, simplejsondb.ModeRead); err != nil {
-		t.Fatalf("reader2 lock err: %v", err)
-	}
-
-	lock := c.GetLock(id)
-	if lock == nil || lock.WG == nil {
-		t.Fatalf("expected non-nil WaitGroup for id %s", id)
-	}
-
-	released := make(chan struct{}, 1)
-	go func(wg *sync.WaitGroup) {
 		wg.Wait()
-		released <- struct{}{}
-	}(lock.WG)
-
-	// Ensure Wait() is actually waiting
-	select {
-	case <-released:
-		t.Fatalf("WaitGroup finished before unlocks")
-	case <-time.After(200 * time.Millisecond):
-		// still waiting, as expected
-	}
-
-	// Unlock twice; after this WG should be done and cleaned eventually
-	if err := c.UnlockID(id); err != nil {
-		t.Fatalf("unlock reader1: %v", err)
-	}
-	if err := c.UnlockID(id); err != nil {
-		t.Fatalf("unlock reader2: %v", err)
-	}
-
-	select {
-	case <-released:
-		// OK
-	case <-time.After(2 * time.Second):
-		t.Fatalf("WaitGroup did not finish after all unlocks")
-	}
+
+		// a failed acquisition rolls back the locks already taken
+		held, err := c.LockID("b", simplejsondb.ModeWrite, simplejsondb.LockOptions{Owner: "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.LockIDs([]string{"c", "b", "a"}, simplejsondb.ModeWrite, simplejsondb.LockOptions{Timeout: 100 * time.Millisecond})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+		}
+		if c.IsLock("a") || c.IsLock("c") {
+			t.Errorf("locks taken before the failure should be released")
+		}
+		if err := c.UnlockID("b", held.Token); err != nil {
+			t.Fatal(err)
+		}
+	})
 }
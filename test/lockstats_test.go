@@ -0,0 +1,130 @@
+package test_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestCollection_Locks(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := c.LockID("a", simplejsondb.ModeRead, simplejsondb.LockOptions{Owner: "r1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := c.LockID("a", simplejsondb.ModeRead, simplejsondb.LockOptions{Owner: "r2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.LockID("b", simplejsondb.ModeWrite, simplejsondb.LockOptions{Owner: "w"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a writer queues up behind the readers
+	acquired := make(chan *simplejsondb.Lease, 1)
+	go func() {
+		lease, _ := c.LockID("a", simplejsondb.ModeWrite, simplejsondb.LockOptions{Owner: "queued"})
+		acquired <- lease
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	locks := c.Locks()
+	if len(locks) != 2 {
+		t.Fatalf("expected 2 held locks, got %+v", locks)
+	}
+	a, b := locks[0], locks[1]
+	if a.ID != "a" || a.Mode != simplejsondb.ModeRead || a.Readers != 2 || a.Waiters != 1 ||
+		strings.Join(a.Owners, ",") != "r1,r2" || a.Held < 100*time.Millisecond {
+		t.Errorf("unexpected lock info %+v", a)
+	}
+	if b.ID != "b" || b.Mode != simplejsondb.ModeWrite || b.Readers != 0 || b.Waiters != 0 ||
+		strings.Join(b.Owners, ",") != "w" {
+		t.Errorf("unexpected lock info %+v", b)
+	}
+
+	for _, lease := range []*simplejsondb.Lease{r1, r2, w} {
+		if err := c.UnlockID(lease.ID, lease.Token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queued := <-acquired
+	if err := c.UnlockID("a", queued.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := c.LockStats()
+	if stats.Acquisitions != 4 || stats.Contended != 1 || stats.WaitTime < 50*time.Millisecond {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var buf bytes.Buffer
+	if err := db.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`simplejsondb_lock_acquisitions_total{collection="stats"} 4`,
+		`simplejsondb_lock_contended_total{collection="stats"} 1`,
+		`simplejsondb_locks_held{collection="stats"} 0`,
+		`# TYPE simplejsondb_lock_wait_seconds_total counter`,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("metrics missing %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+// metrics written while LoadFrom drops the collections cover the handles taken at the start
+func TestDB_WriteMetricsLoadFrom(t *testing.T) {
+	saved := randName(6)
+	defer os.RemoveAll(saved)
+
+	db, err := simplejsondb.NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveTo(saved); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := db.WriteMetrics(io.Discard); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		for _, name := range []string{"collection1", "collection2", "collection3"} {
+			if _, err := db.Collection(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.LoadFrom(saved); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
@@ -0,0 +1,169 @@
+package test_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestMemory_SaveAndLoad(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.NewMemory(simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"key1", "key2"} {
+		if err := c.Create(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(simplejsondb.MemoryName); !os.IsNotExist(err) {
+		t.Errorf("a memory database should not touch the disk, got %v", err)
+	}
+	lease, err := c.TryLockID("key1", simplejsondb.ModeWrite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.TryLockID("key1", simplejsondb.ModeRead); !errors.Is(err, simplejsondb.ErrLockBusy) {
+		t.Errorf("expected ErrLockBusy, got %v", err)
+	}
+	if err := c.UnlockID("key1", lease.Token); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot is a normal database directory
+	if err := db.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "collection1", "key2"+simplejsondb.GZipExt)); err != nil {
+		t.Error(err)
+	}
+	disk, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := disk.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := dc.Get("key2"); err != nil || string(data) != "key2" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if err := dc.Create("key3", []byte("key3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// loading replaces the memory content with the directory
+	mem, err := simplejsondb.NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.LoadFrom(path); err != nil {
+		t.Fatal(err)
+	}
+	if mem.Meta().Compression != simplejsondb.CompressionGzip {
+		t.Errorf("loaded database should adopt the stored format, got %+v", mem.Meta())
+	}
+	mc, err := mem.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mc.Len() != 3 || len(mc.GetAllByName()) != 3 {
+		t.Errorf("expected 3 records, got %d", mc.Len())
+	}
+	if data, err := mc.Get("key3"); err != nil || string(data) != "key3" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if err := mem.LoadFrom(randName(6)); err == nil {
+		t.Error("loading a missing directory should fail")
+	}
+}
+
+func TestMemory_LoadFromDropsCollections(t *testing.T) {
+	path, src := randName(6), randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(src)
+
+	mem, err := simplejsondb.NewMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := mem.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mc.Create("key1", []byte("loaded")); err != nil {
+		t.Fatal(err)
+	}
+	// a leftover of an interrupted save does not get in the way
+	if err := os.MkdirAll(filepath.Join(src+".old", "collection1"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := mem.SaveTo(src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(src + ".old"); !os.IsNotExist(err) {
+		t.Errorf("save should clean up, got %v", err)
+	}
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key2", []byte("stale")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.LoadFrom(src); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handle opened before is dropped instead of writing into the loaded content
+	if err := c.Create("key3", []byte("stale")); !errors.Is(err, simplejsondb.ErrDropped) {
+		t.Errorf("expected ErrDropped, got %v", err)
+	}
+	if _, err := c.Get("key1"); !errors.Is(err, simplejsondb.ErrDropped) {
+		t.Errorf("expected ErrDropped, got %v", err)
+	}
+	if err := c.Migrate(simplejsondb.Options{Compression: simplejsondb.CompressionGzip}); !errors.Is(err, simplejsondb.ErrDropped) {
+		t.Errorf("expected ErrDropped, got %v", err)
+	}
+	if c.Len() != 0 || len(c.GetAll()) != 0 {
+		t.Errorf("a dropped collection should list no records, got %d", c.Len())
+	}
+
+	c2, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all := c2.GetAllByName(); len(all) != 1 || string(all["key1"]) != "loaded" {
+		t.Errorf("unexpected records %q", all)
+	}
+	if c2.Meta().Compression != simplejsondb.CompressionNone {
+		t.Errorf("loaded metadata should be kept, got %+v", c2.Meta())
+	}
+}
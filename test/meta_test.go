@@ -0,0 +1,128 @@
+package test_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestDB_Meta(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := db.Meta(); m.Compression != simplejsondb.CompressionGzip || m.FormatVersion != simplejsondb.FormatVersion {
+		t.Errorf("unexpected db metadata %+v", m)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := c.Meta(); m.Compression != simplejsondb.CompressionGzip || m.Codec != simplejsondb.CodecJSON {
+		t.Errorf("unexpected collection metadata %+v", m)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if c.Len() != 1 {
+		t.Errorf("metadata file should not count as a record, got %d", c.Len())
+	}
+
+	// reopening without options adopts the stored format
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c2.Get("key1"); err != nil {
+		t.Error(err)
+	}
+
+	// options leaving the format alone adopt it as well
+	db4, err := simplejsondb.New(path, &simplejsondb.Options{ExternalWatch: simplejsondb.WatchPoll, PollInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := db4.Meta(); m.Compression != simplejsondb.CompressionGzip {
+		t.Errorf("expected the stored compression, got %+v", m)
+	}
+	db4.Close()
+
+	// reopening with conflicting options is rejected
+	_, err = simplejsondb.New(path, &simplejsondb.Options{Compression: simplejsondb.CompressionNone})
+	if !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+	}
+
+	// so is a collection stored in another format than the options ask for
+	metaFile := filepath.Join(path, "collection1", simplejsondb.MetaFile)
+	m := c.Meta()
+	m.Compression = simplejsondb.CompressionSnappy
+	data, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(metaFile, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	db3, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db3.Collection("collection1"); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+	}
+	// unless Migrate chose that format
+	m.Migrated = true
+	if data, err = json.Marshal(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(metaFile, data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db3.Collection("collection1"); err != nil {
+		t.Errorf("a migrated collection should open, got %v", err)
+	}
+}
+
+func TestCollection_HiddenKey(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// such a record would be stored next to the metadata but never listed
+	for _, key := range []string{"", ".key1", ".meta"} {
+		if err := c.Create(key, []byte(`{"a": 1}`)); !errors.Is(err, simplejsondb.ErrInvalidKey) {
+			t.Errorf("%q: expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+	if c.Len() != 0 {
+		t.Errorf("expected no records, got %d", c.Len())
+	}
+}
@@ -0,0 +1,134 @@
+package test_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestCollection_Migrate(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"v": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(path, "collection1")
+	count := func(ext string) int {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"+ext))
+		return len(files)
+	}
+
+	var last simplejsondb.MigrateProgress
+	calls := 0
+	err = c.Migrate(simplejsondb.Options{Compression: simplejsondb.CompressionZstd}, func(p simplejsondb.MigrateProgress) {
+		last = p
+		calls++
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 10 || last.Total != 10 || last.Rewritten != 10 || last.Skipped != 0 {
+		t.Errorf("unexpected progress %+v after %d reports", last, calls)
+	}
+	if count(simplejsondb.ZstdExt) != 10 || count(simplejsondb.GZipExt) != 0 {
+		t.Errorf("expected 10 zstd and no gzip records, got %d and %d", count(simplejsondb.ZstdExt), count(simplejsondb.GZipExt))
+	}
+	if c.Meta().Compression != simplejsondb.CompressionZstd {
+		t.Errorf("metadata should follow the migration, got %+v", c.Meta())
+	}
+	if data, err := c.Get("key3"); err != nil || string(data) != `{"v": 3}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	// new writes use the target format
+	if err := c.Create("key10", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "key10"+simplejsondb.ZstdExt)); err != nil {
+		t.Error(err)
+	}
+
+	// running again only finishes what is left
+	if err := os.WriteFile(filepath.Join(dir, "key11"+simplejsondb.Ext), []byte(`{"v": 11}`), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	err = c.Migrate(simplejsondb.Options{Compression: simplejsondb.CompressionZstd, Layout: simplejsondb.LayoutSharded}, func(p simplejsondb.MigrateProgress) {
+		last = p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Total != 12 || last.Rewritten != 1 || last.Skipped != 11 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	if c.Len() != 12 || count(simplejsondb.ZstdExt) != 0 {
+		t.Errorf("records should have moved into shards, got %d", c.Len())
+	}
+
+	// the collection keeps its format when the database is opened again
+	db2, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := c2.Meta(); m.Compression != simplejsondb.CompressionZstd || m.Layout != simplejsondb.LayoutSharded {
+		t.Errorf("unexpected metadata %+v", m)
+	}
+	if data, err := c2.Get("key11"); err != nil || string(data) != `{"v": 11}` {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+}
+
+func TestCollection_MigrateSegments(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Engine: simplejsondb.EngineSegment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var last simplejsondb.MigrateProgress
+	if err := c.Migrate(simplejsondb.Options{Compression: simplejsondb.CompressionSnappy}, func(p simplejsondb.MigrateProgress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.Rewritten != 5 {
+		t.Errorf("unexpected progress %+v", last)
+	}
+	if all := c.GetAllByName(); len(all) != 5 || string(all["key4"]) != "v4" {
+		t.Errorf("unexpected records %q", all)
+	}
+}
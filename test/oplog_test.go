@@ -0,0 +1,281 @@
+package test_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestDB_Oplog(t *testing.T) {
+	path := randName(6)
+	target := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(target)
+
+	hashKey := []byte("oplog secret")
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{Payload: true, MaxSize: 512, HashKey: hashKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Create(fmt.Sprintf("user-%d", i), []byte(fmt.Sprintf(`{"n": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Delete("user-3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(path, simplejsondb.OplogDir, "*"+simplejsondb.OplogExt))
+	if len(segments) < 2 {
+		t.Errorf("expected the oplog to rotate, got %v", segments)
+	}
+
+	var entries []simplejsondb.OplogEntry
+	err = db.ReadOplog(5, func(e simplejsondb.OplogEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 || entries[0].Seq != 5 || entries[6].Op != simplejsondb.OpDelete || entries[6].Key != "user-3" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if entries[0].Collection != "users" || entries[0].Hash == "" || string(entries[0].Payload) != `{"n": 4}` {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+	// the hash is keyed, so guessing the value does not confirm it
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte(`{"n": 4}`))
+	plain := sha256.Sum256([]byte(`{"n": 4}`))
+	if entries[0].Hash != hex.EncodeToString(mac.Sum(nil)) || entries[0].Hash == hex.EncodeToString(plain[:]) {
+		t.Errorf("expected an HMAC of the payload, got %s", entries[0].Hash)
+	}
+
+	// feed another database from the log
+	other, err := simplejsondb.New(target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.ReplayOplog(0, other); err != nil {
+		t.Fatal(err)
+	}
+	oc, err := other.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oc.Len() != 9 {
+		t.Errorf("expected 9 replayed records, got %d", oc.Len())
+	}
+	if data, err := oc.Get("user-7"); err != nil || string(data) != `{"n": 7}` {
+		t.Errorf("unexpected replayed record %q, %v", data, err)
+	}
+	if _, err := oc.Get("user-3"); err == nil {
+		t.Errorf("deleted record should not be replayed")
+	}
+
+	// sequence numbers carry on after reopening, retention drops old segments
+	db2, err := simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{MaxSize: 512, MaxFiles: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Delete("user-4"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Create("user-11", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ = filepath.Glob(filepath.Join(path, simplejsondb.OplogDir, "*"+simplejsondb.OplogExt))
+	if len(segments) != 2 {
+		t.Errorf("expected 2 retained segments, got %v", segments)
+	}
+	var last simplejsondb.OplogEntry
+	db2.ReadOplog(0, func(e simplejsondb.OplogEntry) error {
+		last = e
+		return nil
+	})
+	if last.Seq != 13 || last.Key != "user-11" {
+		t.Errorf("unexpected last entry %+v", last)
+	}
+
+	// creates logged without payload cannot be replayed
+	if err := db2.ReplayOplog(13, other); !errors.Is(err, simplejsondb.ErrNoPayload) {
+		t.Errorf("expected ErrNoPayload, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "users", "user-11.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDB_ReplayOplogIntoItself(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{Payload: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Create(fmt.Sprintf("user-%d", i), []byte(fmt.Sprintf(`{"n": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the creates replayed are logged into the segment being read, they are not replayed again
+	done := make(chan error, 1)
+	go func() { done <- db.ReplayOplog(0, nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("replay into the logging database does not end")
+	}
+
+	var seq uint64
+	db.ReadOplog(0, func(e simplejsondb.OplogEntry) error {
+		seq = e.Seq
+		return nil
+	})
+	if seq != 6 {
+		t.Errorf("expected 3 replayed entries logged after the 3 written, got last seq %d", seq)
+	}
+	if c.Len() != 3 {
+		t.Errorf("expected 3 records, got %d", c.Len())
+	}
+}
+
+func TestDB_OplogEncryptedCollection(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	keys, err := simplejsondb.NewStaticKeys("k1", newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{Payload: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Collection("secrets", simplejsondb.Options{Encryption: keys}); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+	}
+	db.Close()
+
+	// without payloads the log holds no values, nor unkeyed hashes of them
+	db, err = simplejsondb.New(path, &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("secrets", simplejsondb.Options{Encryption: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"pin": 1234}`)); err != nil {
+		t.Fatal(err)
+	}
+	db.ReadOplog(0, func(e simplejsondb.OplogEntry) error {
+		if e.Payload != nil || e.Hash != "" {
+			t.Errorf("unexpected entry %+v", e)
+		}
+		return nil
+	})
+}
+
+// an empty segment left by a crash right after rotating does not restart the sequence
+func TestDB_OplogEmptySegment(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	opts := &simplejsondb.Options{Oplog: &simplejsondb.OplogOptions{}}
+	db, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(`{"a": 1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(path, simplejsondb.OplogDir, fmt.Sprintf("%020d%s", 3, simplejsondb.OplogExt))
+	if err := os.WriteFile(empty, nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if c, err = db.Collection("collection1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key2", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	var seqs []uint64
+	err = db.ReadOplog(0, func(e simplejsondb.OplogEntry) error {
+		seqs = append(seqs, e.Seq)
+		return nil
+	})
+	if err != nil || fmt.Sprint(seqs) != "[1 2 3]" {
+		t.Errorf("expected entries 1 to 3, got %v %v", seqs, err)
+	}
+}
@@ -0,0 +1,62 @@
+package test_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestDB_ReadOnly(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	// a missing database is not created
+	if _, err := simplejsondb.New(path, &simplejsondb.Options{ReadOnly: true}); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("read-only open should not create %s", path)
+	}
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("key1", []byte(`{"a": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := simplejsondb.New(path, &simplejsondb.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ro.Collection("missing"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+	rc, err := ro.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := rc.Get("key1"); err != nil || string(data) != `{"a": 1}` {
+		t.Errorf("unexpected read %q, %v", data, err)
+	}
+	if err := rc.Create("key2", []byte(`{}`)); !errors.Is(err, simplejsondb.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly on create, got %v", err)
+	}
+	if err := rc.Delete("key1"); !errors.Is(err, simplejsondb.ErrReadOnly) {
+		t.Errorf("expected ErrReadOnly on delete, got %v", err)
+	}
+	if rc.Len() != 1 {
+		t.Errorf("expected 1 record, got %d", rc.Len())
+	}
+}
@@ -0,0 +1,205 @@
+package test_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func TestSegment_Engine(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := simplejsondb.Options{Engine: simplejsondb.EngineSegment}
+	c, err := db.Collection("collection1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := c.Meta(); m.Engine != simplejsondb.EngineSegment {
+		t.Errorf("collection should record the segment engine, got %q", m.Engine)
+	}
+	for i := 0; i < 10; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf(`{"v": %d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Create("key1", []byte(`{"v": "gz"}`), simplejsondb.Options{UseGzip: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("key2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("key2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleting a missing record should fail, got %v", err)
+	}
+	check := func(c simplejsondb.Collection) {
+		t.Helper()
+		if c.Len() != 9 || len(c.GetAll()) != 9 {
+			t.Errorf("expected 9 records, got %d", c.Len())
+		}
+		all := c.GetAllByName()
+		if string(all["key1"]) != `{"v": "gz"}` || string(all["key9"]) != `{"v": 9}` {
+			t.Errorf("unexpected records %q", all)
+		}
+		if _, err := c.Get("key2"); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("deleted record should be gone, got %v", err)
+		}
+		if data, err := c.Get("key1"); err != nil || string(data) != `{"v": "gz"}` {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+	}
+	check(c)
+
+	// no record files, only segments
+	if files, _ := filepath.Glob(filepath.Join(path, "collection1", "key*")); len(files) != 0 {
+		t.Errorf("segment engine should not write record files, got %v", files)
+	}
+	// nor record lock files, the segments are locked as a whole
+	if _, err := os.Stat(filepath.Join(path, "collection1", simplejsondb.LockDir)); !os.IsNotExist(err) {
+		t.Errorf("segment engine should not lock records in files, got %v", err)
+	}
+	if _, err := db.Collection("collection1", simplejsondb.Options{Engine: simplejsondb.EngineFiles}); !errors.Is(err, simplejsondb.ErrIncompatibleOptions) {
+		t.Errorf("expected ErrIncompatibleOptions, got %v", err)
+	}
+
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(c)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the key directory is rebuilt on open, the stored engine is adopted
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	c2, err := db2.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(c2)
+	if err := c2.MigrateLayout(simplejsondb.LayoutSharded); !errors.Is(err, simplejsondb.ErrNotSupported) {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestSegment_TornWrite(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{Engine: simplejsondb.EngineSegment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"key1", "key2"} {
+		if err := c.Create(k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// cut the last entry short as a crash mid-write would
+	segments, err := filepath.Glob(filepath.Join(path, "collection1", simplejsondb.SegmentDir, "*"+simplejsondb.SegmentExt))
+	if err != nil || len(segments) == 0 {
+		t.Fatal(segments, err)
+	}
+	last := segments[len(segments)-1]
+	os.Remove(last[:len(last)-len(simplejsondb.SegmentExt)] + simplejsondb.HintExt)
+	info, err := os.Stat(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(last, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	c2, err := db2.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c2.Get("key1"); err != nil || string(data) != "key1" {
+		t.Errorf("unexpected record %q %v", data, err)
+	}
+	if _, err := c2.Get("key2"); err == nil {
+		t.Error("torn record should be dropped")
+	}
+	if err := c2.Create("key3", []byte("key3")); err != nil {
+		t.Fatal(err)
+	}
+	if c2.Len() != 2 {
+		t.Errorf("expected 2 records, got %d", c2.Len())
+	}
+}
+
+func TestSegment_Merge(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{
+		Engine:  simplejsondb.EngineSegment,
+		Segment: &simplejsondb.SegmentOptions{MaxSize: 256, MergeInterval: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	c, err := db.Collection("collection1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 5; i++ {
+			if err := c.Create(fmt.Sprintf("key%d", i), []byte(fmt.Sprintf("%d-%d", i, round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dir := filepath.Join(path, "collection1", simplejsondb.SegmentDir)
+	before, _ := filepath.Glob(filepath.Join(dir, "*"+simplejsondb.SegmentExt))
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := filepath.Glob(filepath.Join(dir, "*"+simplejsondb.SegmentExt))
+	if len(after) >= len(before) {
+		t.Errorf("merge should shrink %d segments, got %d", len(before), len(after))
+	}
+	for i := 0; i < 5; i++ {
+		if data, err := c.Get(fmt.Sprintf("key%d", i)); err != nil || string(data) != fmt.Sprintf("%d-19", i) {
+			t.Errorf("unexpected record %q %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package test_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pnkj-kmr/simple-json-db"
+)
+
+func next(t *testing.T, events <-chan simplejsondb.ChangeEvent) simplejsondb.ChangeEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatalf("watch channel closed")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no change event received")
+	}
+	return simplejsondb.ChangeEvent{}
+}
+
+func TestCollection_Watch(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, &simplejsondb.Options{UseGzip: true, ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := c.Watch(ctx, simplejsondb.WatchFilter{Prefix: "user-"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Create("user-1", []byte(`{"n": 1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Create("order-1", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("user-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	created := next(t, events)
+	if created.Key != "user-1" || created.Op != simplejsondb.OpCreate || string(created.Value) != `{"n": 1}` || created.Version != 1 {
+		t.Errorf("unexpected event %+v", created)
+	}
+	deleted := next(t, events)
+	if deleted.Key != "user-1" || deleted.Op != simplejsondb.OpDelete || deleted.Version != 3 {
+		t.Errorf("unexpected event %+v", deleted)
+	}
+	cancel()
+	for range events {
+		// drained until closed
+	}
+
+	// a new subscriber catches up from the persisted change log
+	if err := c.Create("user-2", []byte(`{"n": 2}`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	resumed, err := c.Watch(ctx2, simplejsondb.WatchFilter{Prefix: "user-", ResumeToken: created.Token()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, resumed); e.Version != 3 || e.Op != simplejsondb.OpDelete {
+		t.Errorf("unexpected replayed event %+v", e)
+	}
+	if e := next(t, resumed); e.Version != 4 || e.Key != "user-2" {
+		t.Errorf("unexpected replayed event %+v", e)
+	}
+	if err := c.Create("user-3", []byte(`{"n": 3}`)); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, resumed); e.Version != 5 || e.Key != "user-3" {
+		t.Errorf("unexpected live event %+v", e)
+	}
+
+	// versions carry on when the database is opened again
+	db2, err := simplejsondb.New(path, &simplejsondb.Options{ChangeLog: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx3, cancel3 := context.WithCancel(context.Background())
+	defer cancel3()
+	events3, err := c2.Watch(ctx3, simplejsondb.WatchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Create("user-4", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, events3); e.Version != 6 {
+		t.Errorf("unexpected version after reopen %+v", e)
+	}
+}
+
+func TestCollection_ChangeLogRotation(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	opts := &simplejsondb.Options{ChangeLog: true, ChangeLogMaxSize: 500}
+	db, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(`{"text": "some value"}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := filepath.Join(path, "feed")
+	for _, name := range []string{simplejsondb.ChangeLogFile, simplejsondb.ChangeLogPrevFile} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || info.Size() > 500 {
+			t.Errorf("%s: expected at most 500 bytes, got %v", name, err)
+		}
+	}
+
+	// subscribers shortly behind still catch up, those further behind are told so
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := c.Watch(ctx, simplejsondb.WatchFilter{ResumeToken: "1"}); !errors.Is(err, simplejsondb.ErrChangesPruned) {
+		t.Errorf("expected ErrChangesPruned, got %v", err)
+	}
+	events, err := c.Watch(ctx, simplejsondb.WatchFilter{ResumeToken: "48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, events); e.Version != 49 || e.Key != "key48" {
+		t.Errorf("unexpected replayed event %+v", e)
+	}
+
+	// versions carry on past a rotation
+	db2, err := simplejsondb.New(path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := db2.Collection("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := c2.Watch(ctx, simplejsondb.WatchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c2.Create("key50", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(t, live); e.Version != 51 {
+		t.Errorf("unexpected version after reopen %+v", e)
+	}
+}
+
+// without Options.ChangeLog changes only reach the live subscribers
+func TestCollection_WatchWithoutChangeLog(t *testing.T) {
+	path := randName(6)
+	defer func(dir ...string) {
+		if err := remove(dir...); err != nil {
+			t.Error(err)
+		}
+	}(path)
+
+	db, err := simplejsondb.New(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := db.Collection("feed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Watch(ctx, simplejsondb.WatchFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.Create(fmt.Sprintf("key%d", i), []byte(`{}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := next(t, events)
+	last := next(t, events)
+	if first.Key != "key0" || last.Key != "key1" || string(last.Value) != `{}` {
+		t.Errorf("unexpected events %+v %+v", first, last)
+	}
+	if _, err := os.Stat(filepath.Join(path, "feed", simplejsondb.ChangeLogFile)); !os.IsNotExist(err) {
+		t.Errorf("expected no change log, got %v", err)
+	}
+
+	// nothing missed, nothing to replay
+	if _, err := c.Watch(ctx, simplejsondb.WatchFilter{ResumeToken: last.Token()}); err != nil {
+		t.Errorf("expected a resume without missed events to work, got %v", err)
+	}
+	if _, err := c.Watch(ctx, simplejsondb.WatchFilter{ResumeToken: first.Token()}); !errors.Is(err, simplejsondb.ErrChangesPruned) {
+		t.Errorf("expected ErrChangesPruned, got %v", err)
+	}
+}
@@ -1,24 +1,77 @@
 package simplejsondb
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type db struct {
-	useGzip bool
-	path    string
+	fs          FS
+	compression string
+	codecs      codecs
+	readOnly    bool
+	strict      strictness // collections must agree with the options too
+	opts        Options
+	hooks       hooks
+	oplog       *oplog
+	path        string
+	meta        *Metadata
+	mu          sync.Mutex
+	collections map[string]*collection
+
+	snapMu   sync.Mutex    // held by a running snapshot
+	snapping bool          // under mu, collections opened meanwhile join it
+	snapCols []*collection // under mu, the collections recording their writes for it
 }
 
 type collection struct {
-	useGzip   bool
-	mu        sync.RWMutex
-	name      string
-	path      string
-	recMu     sync.Mutex
-	recModes  map[string]LockMode
-	recLocks  map[string]*sync.RWMutex
-	recStates map[string]*LockState
-	recWg     map[string]*sync.WaitGroup
+	fs          FS
+	compression string // of new writes
+	codecs      codecs
+	// payloads below it are stored uncompressed, see Options.CompressMinSize
+	compressMinSize int
+	readOnly        bool
+	layout          string
+	engine          string
+	store           *segmentStore // set for EngineSegment
+	keys            KeyProvider   // seals new writes when set
+	meta            *Metadata
+	mu              sync.RWMutex
+	dropped         atomic.Bool // set under mu by LoadFrom, the handle is unusable from then on
+	name            string
+	path            string
+	recMu           sync.Mutex
+	recModes        map[string]LockMode
+	recLocks        map[string]*sync.RWMutex
+	recStates       map[string]*LockState
+	recWg           map[string]*sync.WaitGroup
+	recWaiters      map[string]int
+	recOps          map[string]int // record operations holding the lock, see holdRecord
+	recLeases       map[string]*lease
+	recWaits        map[*waiter]struct{}
+	anonymous       atomic.Uint64 // owners handed out to locks taken without one
+	stats           lockCounters
+	recFiles        map[string]*recordFile // under recMu
+
+	feedMu        sync.Mutex
+	version       uint64
+	versionLoaded bool
+	changeLog     bool  // changes are appended to ChangeLogFile, see Options.ChangeLog
+	changeSize    int64 // of ChangeLogFile
+	changeMaxSize int64
+	subscribers   map[*subscriber]struct{}
+	watcher       atomic.Pointer[fsWatcher]
+
+	hooks   hooks
+	dbHooks *hooks
+	oplog   *oplog
+
+	snapMu sync.Mutex
+	dirty  map[string]struct{} // files written while a snapshot runs
 }
 
 // LockMode is an enum for lock modes used by manual locking APIs.
@@ -35,9 +88,111 @@ const (
 	ModeReadWrite
 )
 
+// LockScope - how far a lock taken through LockID reaches
+type LockScope int
+
+const (
+	// ScopeProcess coordinates the goroutines of this process only.
+	ScopeProcess LockScope = iota
+	// ScopeInterProcess additionally holds an advisory OS file lock on the record,
+	// excluding other processes sharing the database directory.
+	ScopeInterProcess
+)
+
+// LockOptions - extra configuration for LockID
+type LockOptions struct {
+	Scope LockScope
+	// Timeout bounds how long the acquisition waits, zero waits forever
+	Timeout time.Duration
+	// TTL is the lease lifetime, the lease never expires when it is zero or negative
+	TTL time.Duration
+	// Owner identifies the holder for deadlock detection. Without one every lock gets
+	// an owner of its own, so waits of such a caller are never part of a cycle.
+	Owner string
+}
+
+// Lease - a lock held on a record, identified by its owner token
+type Lease struct {
+	ID       string
+	Token    string
+	Mode     LockMode
+	Scope    LockScope
+	Owner    string
+	TTL      time.Duration
+	Acquired time.Time
+	Expires  time.Time // zero when the lease never expires
+}
+
+// ExternalWatch - how collection directories are watched for changes made outside the library
+type ExternalWatch int
+
+const (
+	// WatchOff ignores outside changes.
+	WatchOff ExternalWatch = iota
+	// WatchAuto uses inotify on Linux and polling elsewhere.
+	WatchAuto
+	// WatchPoll always rescans the directories every PollInterval.
+	WatchPoll
+)
+
 // Options - extra configuration
 type Options struct {
 	UseGzip bool
+	// Compression of new record files, one of the Compression names; it takes
+	// precedence over UseGzip
+	Compression string
+	// CompressionLevel of gzip (1-9) or zstd (1-22), the codec default when zero
+	CompressionLevel int
+	// ZstdDictionary, see TrainZstdDictionary, is used to write and read zstd records
+	ZstdDictionary []byte
+	// CompressMinSize stores payloads smaller than it uncompressed; when set, a
+	// compressed payload is only kept if it is smaller than the original
+	CompressMinSize int
+	// ReadOnly opens an existing database without ever modifying it
+	ReadOnly bool
+	// Lease lets a record operation run under a lock the caller already holds
+	Lease *Lease
+	// ExternalWatch turns outside changes to record files into change events
+	ExternalWatch ExternalWatch
+	// PollInterval is the rescan period of a polling watcher, DefaultPollInterval when zero
+	PollInterval time.Duration
+	// ChangeLog persists the changes of every collection, value included, so a Watch
+	// subscriber can resume from a ResumeToken; without it changes only reach the
+	// subscribers watching at the time
+	ChangeLog bool
+	// ChangeLogMaxSize rotates the change log of a collection, keeping one previous
+	// part, once it would grow past it; DefaultChangeLogMaxSize when zero
+	ChangeLogMaxSize int64
+	// Oplog keeps a log of every mutation in the database directory when set
+	Oplog *OplogOptions
+	// Layout of the record files of new collections, LayoutFlat when empty
+	Layout string
+	// Engine stores the records of new collections, EngineFiles when empty; it may
+	// also be chosen per collection through DB.Collection
+	Engine string
+	// Segment configures collections using EngineSegment
+	Segment *SegmentOptions
+	// FS stores the database, OSFS when nil
+	FS FS
+	// Encryption seals new record payloads with AES-GCM after compression; it may
+	// also be given per collection through DB.Collection
+	Encryption KeyProvider
+}
+
+// Metadata - persisted description of a database or collection, kept in MetaFile
+type Metadata struct {
+	FormatVersion int             `json:"format_version"`
+	Codec         string          `json:"codec"`
+	Compression   string          `json:"compression"`
+	Layout        string          `json:"layout,omitempty"`
+	Engine        string          `json:"engine,omitempty"`
+	Encryption    string          `json:"encryption,omitempty"`
+	Sealed        bool            `json:"sealed,omitempty"`    // every record encrypted, plain ones are refused
+	ZstdDict      uint32          `json:"zstd_dict,omitempty"` // ID of the zstd dictionary records need
+	Migrated      bool            `json:"migrated,omitempty"`  // format set by Migrate, not inherited
+	Schema        json.RawMessage `json:"schema,omitempty"`
+	Indexes       []string        `json:"indexes,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
 }
 
 // internal lock state tracking per ID to support safe unlock semantics
@@ -55,21 +210,57 @@ type RecordLock struct {
 	WG    *sync.WaitGroup
 }
 
+// MultiLease - leases on several records taken together by LockIDs
+type MultiLease struct {
+	Leases []*Lease
+	c      *collection
+}
+
 // Collection - it's like a table name
 type Collection interface {
-	Get(string) ([]byte, error)
+	Get(string, ...Options) ([]byte, error)
 	GetAll() [][]byte
 	GetAllByName() map[string][]byte
 	Create(string, []byte, ...Options) error
-	Delete(string) error
+	Delete(string, ...Options) error
 	Len() uint64
-	LockID(id string, mode LockMode) (LockMode, error)
-	UnlockID(id string) error
+	LockID(id string, mode LockMode, options ...LockOptions) (*Lease, error)
+	TryLockID(id string, mode LockMode, options ...LockOptions) (*Lease, error)
+	LockIDContext(ctx context.Context, id string, mode LockMode, options ...LockOptions) (*Lease, error)
+	LockIDs(ids []string, mode LockMode, options ...LockOptions) (*MultiLease, error)
+	UnlockID(id string, token string) error
+	RenewID(id string, token string, ttl time.Duration) (*Lease, error)
 	GetLock(id string) *RecordLock
 	IsLock(id string) bool
+	Locks() []LockInfo
+	Watch(ctx context.Context, filter WatchFilter) (<-chan ChangeEvent, error)
+	BeforeCreate(BeforeHook)
+	AfterCreate(AfterHook)
+	BeforeDelete(BeforeHook)
+	AfterDelete(AfterHook)
+	LockStats() LockStats
+	Meta() Metadata
+	MigrateLayout(layout string) error
+	Migrate(target Options, progress ...func(MigrateProgress)) error
+	Compact() error
+	RotateKey(progress ...func(MigrateProgress)) error
 }
 
 // DB - a database
 type DB interface {
-	Collection(string) (Collection, error)
+	Collection(string, ...Options) (Collection, error)
+	Meta() Metadata
+	WriteMetrics(w io.Writer) error
+	BeforeCreate(BeforeHook)
+	AfterCreate(AfterHook)
+	BeforeDelete(BeforeHook)
+	AfterDelete(AfterHook)
+	ReadOplog(from uint64, fn func(OplogEntry) error) error
+	ReplayOplog(from uint64, target DB, collections ...string) error
+	SaveTo(path string) error
+	LoadFrom(path string) error
+	Snapshot(dst string) error
+	Backup(w io.Writer) error
+	Check(opts CheckOptions) (*CheckReport, error)
+	Close() error
 }
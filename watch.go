@@ -0,0 +1,270 @@
+package simplejsondb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WatchBuffer - events a subscriber may lag behind before it is dropped
+const WatchBuffer = 256
+
+// DefaultChangeLogMaxSize - size past which the change log of a collection is rotated
+// when Options.ChangeLogMaxSize is zero
+const DefaultChangeLogMaxSize = 16 << 20
+
+// Operations reported by a ChangeEvent
+const (
+	OpCreate = "create"
+	OpDelete = "delete"
+)
+
+// ChangeEvent - a change made to a record of a collection
+type ChangeEvent struct {
+	Key     string    `json:"key"`
+	Op      string    `json:"op"`
+	Value   []byte    `json:"value,omitempty"` // new value, empty on delete
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// Token returns the resume token of the event, Watch continues after it
+func (e ChangeEvent) Token() string {
+	return strconv.FormatUint(e.Version, 10)
+}
+
+// WatchFilter - selects the events a Watch subscriber receives
+type WatchFilter struct {
+	Prefix string
+	// ResumeToken replays the persisted change log after the event with this token first;
+	// Watch returns ErrChangesPruned once the log has been rotated past it, or for any
+	// event missed when Options.ChangeLog is off
+	ResumeToken string
+}
+
+// subscriber - a Watch in progress
+type subscriber struct {
+	prefix  string
+	pending chan ChangeEvent
+}
+
+// Watch returns a channel of changes to records matching filter. The channel is
+// closed once ctx is done, or when the subscriber falls more than WatchBuffer events
+// behind; it then resumes from the token of the last event it received.
+func (c *collection) Watch(ctx context.Context, filter WatchFilter) (<-chan ChangeEvent, error) {
+	if c.dropped.Load() {
+		return nil, ErrDropped
+	}
+	var after uint64
+	if filter.ResumeToken != "" {
+		v, err := strconv.ParseUint(filter.ResumeToken, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid resume token %q: %w", filter.ResumeToken, err)
+		}
+		after = v
+	}
+
+	c.feedMu.Lock()
+	if err := c.loadVersion(); err != nil {
+		c.feedMu.Unlock()
+		return nil, err
+	}
+	// replaying and subscribing under feedMu leaves no gap between the two
+	var backlog []ChangeEvent
+	if filter.ResumeToken != "" && !c.changeLog && after < c.version {
+		c.feedMu.Unlock()
+		return nil, fmt.Errorf("%w: %s, no change log is kept", ErrChangesPruned, filter.ResumeToken)
+	}
+	if filter.ResumeToken != "" && c.changeLog {
+		var oldest uint64
+		err := c.readChanges(func(e ChangeEvent) {
+			if oldest == 0 {
+				oldest = e.Version
+			}
+			if e.Version > after && strings.HasPrefix(e.Key, filter.Prefix) {
+				backlog = append(backlog, e)
+			}
+		})
+		if err == nil && oldest > after+1 {
+			err = fmt.Errorf("%w: %s, the oldest event kept is %d", ErrChangesPruned, filter.ResumeToken, oldest)
+		}
+		if err != nil {
+			c.feedMu.Unlock()
+			return nil, err
+		}
+	}
+	sub := &subscriber{prefix: filter.Prefix, pending: make(chan ChangeEvent, WatchBuffer)}
+	if c.subscribers == nil {
+		c.subscribers = make(map[*subscriber]struct{})
+	}
+	c.subscribers[sub] = struct{}{}
+	c.feedMu.Unlock()
+
+	out := make(chan ChangeEvent)
+	go func() {
+		defer close(out)
+		defer c.unsubscribe(sub)
+		for _, e := range backlog {
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for {
+			select {
+			case e, ok := <-sub.pending:
+				if !ok {
+					return // dropped for falling behind
+				}
+				select {
+				case out <- e:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// helper: removes a subscriber, closing its queue unless publish already did
+func (c *collection) unsubscribe(sub *subscriber) {
+	c.feedMu.Lock()
+	defer c.feedMu.Unlock()
+	if _, ok := c.subscribers[sub]; ok {
+		delete(c.subscribers, sub)
+		close(sub.pending)
+	}
+}
+
+// publish - records a change in the oplog and, when kept, the change log, then hands it
+// to the subscribers. A read-only collection only sees outside changes and keeps them in memory.
+func (c *collection) publish(key, op string, value []byte) error {
+	c.feedMu.Lock()
+	defer c.feedMu.Unlock()
+	if err := c.loadVersion(); err != nil {
+		return err
+	}
+	if c.oplog != nil {
+		if err := c.oplog.append(c.name, key, op, value); err != nil {
+			return err
+		}
+	}
+	e := ChangeEvent{Key: key, Op: op, Value: value, Version: c.version + 1, Time: time.Now().UTC()}
+	if c.changeLog && !c.readOnly {
+		if err := c.appendChange(e); err != nil {
+			return err
+		}
+	}
+	c.version = e.Version
+
+	for sub := range c.subscribers {
+		if !strings.HasPrefix(key, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.pending <- e:
+		default:
+			delete(c.subscribers, sub)
+			close(sub.pending)
+		}
+	}
+	return nil
+}
+
+// helper: reads the latest version and the size of the change log once; feedMu must be held
+func (c *collection) loadVersion() error {
+	if c.versionLoaded {
+		return nil
+	}
+	err := c.readChanges(func(e ChangeEvent) {
+		if e.Version > c.version {
+			c.version = e.Version
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if info, err := c.fs.Stat(filepath.Join(c.path, ChangeLogFile)); err == nil {
+		c.changeSize = info.Size()
+	}
+	c.versionLoaded = true
+	return nil
+}
+
+// helper: calls fn for every event of the change log in order, starting with its
+// rotated part; feedMu must be held
+func (c *collection) readChanges(fn func(ChangeEvent)) error {
+	for _, name := range []string{ChangeLogPrevFile, ChangeLogFile} {
+		data, err := c.fs.ReadFile(filepath.Join(c.path, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.readChangeLines(data, fn)
+	}
+	return nil
+}
+
+// helper: calls fn for every complete event line of data
+func (c *collection) readChangeLines(data []byte, fn func(ChangeEvent)) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var e ChangeEvent
+			if jerr := json.Unmarshal(line, &e); jerr == nil {
+				if isSealed(e.Value) {
+					e.Value, _ = unseal(c.keys, e.Key, e.Value) // dropped without its key
+				}
+				fn(e)
+			}
+		}
+		if err != nil {
+			return // a torn last line is skipped
+		}
+	}
+}
+
+// helper: appends an event to the change log, its value sealed in an encrypted
+// collection; feedMu must be held
+func (c *collection) appendChange(e ChangeEvent) error {
+	if c.keys != nil && e.Value != nil {
+		sealed, err := seal(c.keys, e.Key, e.Value)
+		if err != nil {
+			return err
+		}
+		e.Value = sealed
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	path := filepath.Join(c.path, ChangeLogFile)
+	// past its size the log starts over, the part before is kept for subscribers catching up
+	if c.changeSize > 0 && c.changeSize+int64(len(line)) > c.changeMaxSize {
+		if err := c.fs.Rename(path, filepath.Join(c.path, ChangeLogPrevFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		c.changeSize = 0
+	}
+	if err := appendFile(c.fs, path, line); err != nil {
+		return err
+	}
+	c.changeSize += int64(len(line))
+	return nil
+}